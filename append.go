@@ -1,87 +1,264 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 import (
+	"github.com/disappearinjon/microdrive/journal"
 	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+	"github.com/disappearinjon/microdrive/transfer"
 )
 
 // AppendCmd contains the CLI args and flags for the append command
 type AppendCmd struct {
-	Source string `arg:"positional,required" help:"Hard Drive Image File"`
+	Source string `arg:"positional,required" help:"Hard Drive Image File, zip archive, archive.zip:image, or - for stdin"`
 	Target string `arg:"positional,required" help:"Microdrive/Turbo image file"`
-	Type   string `arg:"-s"  help:"Source file type: auto, 2mg, hdv, po" default:"auto"`
+	Type   string `arg:"-s"  help:"Source file type: auto, 2mg, dc, do, hdv, po, woz; required for stdin" default:"auto"`
 	Force  bool   `help:"Force write even in unsafe conditions" default:"false"`
+	Size   string `help:"Partition size, larger than the image, such as 32M or max (the rest of the card, up to 32M); required for stdin unless the image has a header"`
+	Expand bool   `help:"Grow the ProDOS volume to fill the partition" default:"false"`
+	Verify bool   `help:"Read the partition back after writing, to check it; past the system's cache on 64-bit Linux only" default:"false"`
 }
 
-func appendPartition() error {
-	// Get the size of our source volume, in blocks
-	source, err := os.Open(cli.Append.Source)
-	if err != nil {
-		source.Close()
-		return err
+func appendPartition(ctx context.Context) error {
+	sources := []string{cli.Append.Source}
+
+	// A zip archive with no member named means append all of its
+	// images, in archive order
+	if archive, member, ok := splitArchive(cli.Append.Source); ok && member == "" {
+		images, err := archiveImages(archive)
+		if err != nil {
+			return err
+		}
+		if len(images) == 0 {
+			return fmt.Errorf("archive %s contains no disk images", archive)
+		}
+		sources = sources[:0]
+		for _, image := range images {
+			sources = append(sources, archive+archiveSeparator+image)
+		}
 	}
-	sourceLength, err := getSourceLength(source, cli.Append.Type)
-	source.Close()
-	if err != nil {
-		return fmt.Errorf("could not get %s image length: %v", cli.Append.Target, err)
+
+	if len(sources) > 1 && cli.Append.Size == "max" {
+		return fmt.Errorf("--size max can't be used to append %d images", len(sources))
 	}
-	if sourceLength == -1 {
-		return fmt.Errorf("recieved incorrect image size (-1) for %s", cli.Append.Target)
+	opts := importOptions{
+		Type:   cli.Append.Type,
+		Force:  cli.Append.Force,
+		Expand: cli.Append.Expand,
+		Verify: cli.Append.Verify,
 	}
+	var plan *appendPlan
+	if cli.DryRun {
+		plan = &appendPlan{}
+	}
+	for _, source := range sources {
+		partNum, err := appendImage(ctx, source, cli.Append.Target, cli.Append.Size, opts, plan)
+		if err != nil {
+			return err
+		}
+		if !cli.DryRun {
+			fmt.Fprintf(os.Stderr, "Appended %s as partition %d\n", source, partNum)
+		}
+	}
+	if cli.DryRun {
+		dryRun(cli.Append.Target, plan.before, plan.after,
+			append([]plannedWrite{tableWrite}, plan.writes...))
+	}
+	return nil
+}
 
-	// Length is in bytes; convert to blocks
-	blockCount := sourceLength / mdturbo.SectorSize
-	if sourceLength%mdturbo.SectorSize != 0 {
-		blockCount++
+// appendPlan collects what a dry run of appending one image after
+// another would do, each to the table as the ones before left it
+type appendPlan struct {
+	planned       bool // An append has been planned
+	before, after mdturbo.MDTurbo
+	writes        []plannedWrite
+}
+
+// maxSize is the size asked for with --size max
+const maxSize = -1
+
+// parseSize parses a partition size, in bytes with an optional K, M or
+// G suffix, or "max". Returns the size in sectors, or maxSize.
+func parseSize(size string) (int64, error) {
+	if strings.ToLower(size) == "max" {
+		return maxSize, nil
 	}
-	if blockCount == 0 {
-		return fmt.Errorf("nonsense size for file %s", cli.Append.Source)
-		return nil
+	number := strings.TrimSuffix(strings.ToUpper(size), "B")
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier != 1 {
+			number = number[:len(number)-1]
+		}
 	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("bad size %s", size)
+	}
+	bytes := value * multiplier
+	if bytes%mdturbo.SectorSize != 0 {
+		return 0, fmt.Errorf("size %s is not a whole number of %d byte blocks", size, mdturbo.SectorSize)
+	}
+	return bytes / mdturbo.SectorSize, nil
+}
 
-	// Open the target file
-	target, partMap, err := getTarget(cli.Append.Target, cli.Append.Force)
-	if err != nil {
-		return fmt.Errorf("could not open %s: %v", cli.Append.Target, err)
+// freeSectors returns the number of sectors past the last partition of
+// a card, using the drive geometry if it's set, or else the size of the
+// card image. A device is never taken to hold more than its real size.
+// Returns -1 if the free space can't be found.
+func freeSectors(target *targetCard, partMap mdturbo.MDTurbo) int64 {
+	capacity := int64(partMap.Capacity())
+	size := target.Size() / mdturbo.SectorSize
+	if capacity == 0 || (target.device != nil && size < capacity) {
+		if size < 0 {
+			return -1
+		}
+		capacity = size
+	}
+	free := capacity - int64(partMap.FirstFree())
+	if free < 0 {
+		return 0
 	}
+	return free
+}
 
-	// Add a new partition map
-	partNum, err := partMap.AddPartition(uint32(blockCount))
+// appendImage adds a new partition sized to fit the source image, or of
+// the given size if that's not empty, and imports the image into it.
+// A size must be given for an image of unknown length, such as stdin.
+// Returns the new partition number. For a dry run, the append is added
+// to plan instead.
+func appendImage(ctx context.Context, sourceFile, targetFile, size string, opts importOptions, plan *appendPlan) (int, error) {
+	// Get the size of our source volume, in blocks
+	source, err := openSourceImage(sourceFile, opts.Type)
 	if err != nil {
-		return fmt.Errorf("could not add partition to table on %s: %v", cli.Append.Target, err)
+		return -1, err
 	}
-	if partNum < 0 {
-		return fmt.Errorf("could not get new partition number for %s", cli.Append.Target)
+	defer source.Close()
+	sourceLength := source.Length
+	if sourceLength < 0 && size == "" {
+		return -1, fmt.Errorf("the size of %s is unknown; give --size", source.file.Name())
 	}
 
-	serialized, err := partMap.Serialize()
-	if err != nil {
-		return fmt.Errorf("could not serialize updated partition table for %s: %v", cli.Append.Target, err)
+	// Length is in bytes; convert to blocks
+	var blockCount int64
+	if sourceLength >= 0 {
+		blockCount = (sourceLength + mdturbo.SectorSize - 1) / mdturbo.SectorSize
+		if blockCount == 0 {
+			return -1, fmt.Errorf("nonsense size for file %s", sourceFile)
+		}
 	}
 
-	// Seek to 0 and write it out
-	bytesWritten, err := target.WriteAt(serialized[:], 0)
+	// Open the target file
+	target, partMap, err := getTarget(targetFile, opts.Force)
 	if err != nil {
-		return fmt.Errorf("could not write updated partition table for %s: %v", cli.Append.Target, err)
+		return -1, err
+	}
+	defer target.Close()
+	if plan != nil && plan.planned {
+		partMap = plan.after
 	}
-	if bytesWritten != len(serialized) {
-		return fmt.Errorf("partition table write unexpected length (got %d, expected %d)",
-			bytesWritten, len(serialized))
+
+	// Make room for growth if asked
+	if size != "" {
+		sizeBlocks, err := parseSize(size)
+		if err != nil {
+			return -1, err
+		}
+		free := freeSectors(target, partMap)
+		switch {
+		case sizeBlocks == maxSize && free == -1:
+			return -1, fmt.Errorf("can't tell how much room is left on %s; give a size", targetFile)
+		case sizeBlocks == maxSize && free < blockCount:
+			return -1, fmt.Errorf("%s has %d blocks free; %s needs %d",
+				targetFile, free, sourceFile, blockCount)
+		case sizeBlocks == maxSize:
+			sizeBlocks = free
+			if sizeBlocks > prodos.MaxBlocks {
+				sizeBlocks = prodos.MaxBlocks
+			}
+		case (partMap.Capacity() != 0 || target.device != nil) && sizeBlocks > free:
+			// Without the geometry, a card image just grows
+			return -1, fmt.Errorf("partition of %d blocks won't fit; %s has %d blocks free",
+				sizeBlocks, targetFile, free)
+		}
+		if sizeBlocks < blockCount {
+			return -1, fmt.Errorf("partition of %d blocks is too small for %s (%d blocks)",
+				sizeBlocks, sourceFile, blockCount)
+		}
+		blockCount = sizeBlocks
+	}
+	if free := freeSectors(target, partMap); (partMap.Capacity() != 0 || target.device != nil) &&
+		free >= 0 && blockCount > free {
+		return -1, fmt.Errorf("partition of %d blocks won't fit; %s has %d blocks free",
+			blockCount, targetFile, free)
+	}
+
+	if cli.DryRun {
+		after := partMap
+		partNum, err := after.AddPartition(uint32(blockCount))
+		if err != nil {
+			return -1, fmt.Errorf("could not add partition to table on %s: %v", targetFile, err)
+		}
+		partition, err := after.GetPartition(uint8(partNum))
+		if err != nil {
+			return -1, fmt.Errorf("failed to get partition: %v", err)
+		}
+		if !plan.planned {
+			plan.before, plan.planned = partMap, true
+		}
+		plan.after = after
+		plan.writes = append(plan.writes, importWrites(partition, uint8(partNum), sourceLength, opts)...)
+		return partNum, nil
 	}
 
-	// Flush and close
-	err = target.Sync()
+	err = saveUndo(target, tableRange, journal.Range{
+		Offset: int64(partMap.FirstFree()) * mdturbo.SectorSize,
+		Length: blockCount * mdturbo.SectorSize,
+	})
 	if err != nil {
-		return err
+		return -1, err
 	}
-	err = target.Close()
+
+	// Copy the image into the space for the new partition; the table
+	// isn't touched until that's done
+	data, report, sums := importReader(source, opts.Verify)
+	partNum, written, err := transfer.Append(ctx, target, &partMap, uint32(blockCount), data, sourceLength)
+	report.Finish()
+	switch {
+	case transfer.IsCancelled(err) != nil:
+		return -1, fmt.Errorf("append of %s was %v; the partition table is unchanged", sourceFile, err)
+	case err == transfer.ErrTooLarge:
+		return -1, fmt.Errorf("%s is larger than the new partition (%d blocks); the partition table is unchanged",
+			sourceFile, blockCount)
+	case err != nil:
+		return -1, fmt.Errorf("could not append to %s: %v", targetFile, err)
+	}
+	partition, err := partMap.GetPartition(partNum)
 	if err != nil {
-		return err
+		return -1, fmt.Errorf("failed to get partition: %v", err)
+	}
+	if err = finishImport(target, partition, partNum, written, sums, opts); err != nil {
+		return -1, err
 	}
 
-	return importImage(cli.Append.Source, cli.Append.Target, cli.Append.Type, uint8(partNum), cli.Append.Force)
+	// Only now that the data is in place, add the partition to the table
+	if err = transfer.WriteTable(target, partMap); err != nil {
+		return -1, fmt.Errorf("could not update partition table on %s: %v", targetFile, err)
+	}
+	return int(partNum), target.Commit()
 }
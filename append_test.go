@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/transfer"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		size    string
+		sectors int64
+		bad     bool
+	}{
+		{"max", maxSize, false},
+		{"MAX", maxSize, false},
+		{"512", 1, false},
+		{"1K", 2, false},
+		{"1kb", 2, false},
+		{"32M", 65536, false},
+		{"32mb", 65536, false},
+		{"1G", 2097152, false},
+		{"0", 0, true},
+		{"0M", 0, true},
+		{"-1M", 0, true},
+		{"", 0, true},
+		{"M", 0, true},
+		{"lots", 0, true},
+		{"1.5M", 0, true},
+		{"100", 0, true}, // Not a whole block
+		{"32T", 0, true},
+	} {
+		sectors, err := parseSize(tc.size)
+		if tc.bad {
+			if err == nil {
+				t.Errorf("%q: parsed as %d sectors, expected an error", tc.size, sectors)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.size, err)
+		} else if sectors != tc.sectors {
+			t.Errorf("%q: parsed as %d sectors, expected %d", tc.size, sectors, tc.sectors)
+		}
+	}
+}
+
+// newCardFile writes a card image of blocks sectors holding a table, in
+// a temporary directory, and returns its name
+func newCardFile(t *testing.T, dir string, table mdturbo.MDTurbo, blocks int64) string {
+	name := filepath.Join(dir, "card.mdt")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("could not create card: %v", err)
+	}
+	defer file.Close()
+	if err = file.Truncate(blocks * mdturbo.SectorSize); err != nil {
+		t.Fatalf("could not size card: %v", err)
+	}
+	if err = transfer.WriteTable(file, table); err != nil {
+		t.Fatalf("could not write table: %v", err)
+	}
+	return name
+}
+
+func TestFreeSectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	table := mdturbo.MDTurbo{Magic: 52426}
+	table.AddPartition(100)
+	target, err := openTarget(newCardFile(t, dir, table, 400), false)
+	if err != nil {
+		t.Fatalf("could not open card: %v", err)
+	}
+	defer target.Close()
+
+	// Without the geometry, the image size counts
+	if free := freeSectors(target, table); free != 44 {
+		t.Errorf("%d sectors free by image size, expected 44", free)
+	}
+	table.Cylinders, table.Heads, table.Sectors = 10, 1, 100
+	if free := freeSectors(target, table); free != 644 {
+		t.Errorf("%d sectors free by geometry, expected 644", free)
+	}
+	table.AddPartition(700)
+	if free := freeSectors(target, table); free != 0 {
+		t.Errorf("%d sectors free on an overfull card, expected 0", free)
+	}
+}
+
+func TestAppendTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 644 sectors are free by the geometry
+	table := mdturbo.MDTurbo{Magic: 52426, Cylinders: 10, Heads: 1, Sectors: 100}
+	table.AddPartition(100)
+	card := newCardFile(t, dir, table, 400)
+	before, err := ioutil.ReadFile(card)
+	if err != nil {
+		t.Fatalf("could not read card: %v", err)
+	}
+
+	for _, tc := range []struct {
+		blocks int64
+		size   string
+		err    string
+	}{
+		{280, "1M", "won't fit"},
+		{700, "", "won't fit"},
+		{700, "max", "has 644 blocks free"},
+	} {
+		source := filepath.Join(dir, "disk.po")
+		if err = ioutil.WriteFile(source, make([]byte, tc.blocks*mdturbo.SectorSize), 0666); err != nil {
+			t.Fatalf("could not write source: %v", err)
+		}
+		_, err = appendImage(context.Background(), source, card, tc.size, importOptions{Type: "auto"}, nil)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%d block image, size %q: returned %v, expected %q", tc.blocks, tc.size, err, tc.err)
+		}
+		if after, _ := ioutil.ReadFile(card); string(after) != string(before) {
+			t.Errorf("%d block image, size %q: card was changed", tc.blocks, tc.size)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/journal"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/patch"
+	"github.com/disappearinjon/microdrive/transfer"
+)
+
+// ApplypatchCmd applies a patch made by mkpatch to a card
+type ApplypatchCmd struct {
+	Patch  string `arg:"positional,required" help:"Patch file made by mkpatch"`
+	Target string `arg:"positional,required" help:"Card to patch: a Microdrive/Turbo image file, or a device"`
+}
+
+func applyPatch(ctx context.Context) error {
+	if err := refuseCompressed(cli.Applypatch.Target); err != nil {
+		return err
+	}
+	file, err := os.Open(cli.Applypatch.Patch)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p, err := patch.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", cli.Applypatch.Patch, err)
+	}
+	if err = p.Verify(); err != nil {
+		return fmt.Errorf("could not read %s: %v", cli.Applypatch.Patch, err)
+	}
+
+	target, err := openTarget(cli.Applypatch.Target, false)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", cli.Applypatch.Target, err)
+	}
+	defer target.Close()
+	if err = p.Check(target, target.Size()); err != nil {
+		return fmt.Errorf("won't patch %s: %v", cli.Applypatch.Target, err)
+	}
+	if target.device != nil && p.Size > target.Size() {
+		return fmt.Errorf("patched card would be %d bytes; %s holds only %d",
+			p.Size, cli.Applypatch.Target, target.Size())
+	}
+
+	writes := make([]plannedWrite, len(p.Regions))
+	for i, r := range p.Regions {
+		what := "patched partition table or unpartitioned space"
+		if r.Partition >= 0 {
+			what = fmt.Sprintf("patched data in partition %d", r.Partition)
+		}
+		writes[i] = plannedWrite{journal.Range{Offset: r.Offset, Length: r.Length}, what}
+	}
+	// An image file takes the size of the new card; a device keeps its own
+	resize := target.device == nil && target.Size() != p.Size
+	if cli.DryRun {
+		return dryRunPatch(p, writes, resize)
+	}
+	ranges := make([]journal.Range, len(writes))
+	for i, w := range writes {
+		ranges[i] = w.Range
+	}
+	if resize && target.Size() > p.Size {
+		// Save the tail the new size cuts off, so undo can put it back
+		ranges = append(ranges, journal.Range{Offset: p.Size, Length: target.Size() - p.Size})
+	}
+	if err = saveUndo(target, ranges...); err != nil {
+		return err
+	}
+
+	written, err := p.Apply(ctx, target)
+	if transfer.IsCancelled(err) != nil {
+		return fmt.Errorf("patch was cancelled after writing %d bytes; %s is only partly patched",
+			written, cli.Applypatch.Target)
+	}
+	if err != nil {
+		return fmt.Errorf("could not patch %s: %v", cli.Applypatch.Target, err)
+	}
+	if resize {
+		if err = target.Truncate(p.Size); err != nil {
+			return fmt.Errorf("could not resize %s: %v", cli.Applypatch.Target, err)
+		}
+	}
+	if err = target.Commit(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Patched %s\n", cli.Applypatch.Target)
+	printPatch(p)
+	return nil
+}
+
+// dryRunPatch prints what applying a patch would do
+func dryRunPatch(p *patch.Patch, writes []plannedWrite, resize bool) error {
+	before, err := GetPartitionTable(cli.Applypatch.Target)
+	if err != nil {
+		return err
+	}
+	after := before
+	data, err := p.Data(0)
+	if err != nil {
+		return err
+	}
+	if len(data) >= mdturbo.PartitionBlkLen {
+		var sector [mdturbo.PartitionBlkLen]byte
+		copy(sector[:], data)
+		if after, err = mdturbo.Deserialize(sector); err != nil {
+			return err
+		}
+	}
+	dryRun(cli.Applypatch.Target, before, after, writes)
+	if resize {
+		fmt.Printf("Would set the size of %s to %d bytes\n", cli.Applypatch.Target, p.Size)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/diskimage"
+)
+
+// archiveSeparator separates an archive filename from a member name in
+// a source specification, as in archive.zip:inner/path.po
+const archiveSeparator = ":"
+
+// zipMagic is the signature at the start of a zip archive
+var zipMagic = []byte("PK\x03\x04")
+
+// isZipFile returns true if the named file exists and is a zip archive
+func isZipFile(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, len(zipMagic))
+	if _, err = io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, zipMagic)
+}
+
+// splitArchive splits a source specification into an archive filename
+// and an optional member name. ok is false if the source is not a zip
+// archive.
+func splitArchive(source string) (archive, member string, ok bool) {
+	if isZipFile(source) {
+		return source, "", true
+	}
+	sep := strings.Index(source, archiveSeparator)
+	for sep != -1 {
+		if isZipFile(source[:sep]) {
+			return source[:sep], source[sep+1:], true
+		}
+		next := strings.Index(source[sep+1:], archiveSeparator)
+		if next == -1 {
+			break
+		}
+		sep += next + 1
+	}
+	return "", "", false
+}
+
+// archiveMember is a disk image in a zip archive, decompressed as it's
+// read. Reads should mostly go forwards: reading backwards opens the
+// member again, and decompresses it from the start.
+type archiveMember struct {
+	name    string
+	file    *zip.File
+	archive io.Closer // Closed with the member, if set
+
+	mu     sync.Mutex    // Guards stream and pos
+	stream io.ReadCloser // Decompressed member data
+	pos    int64         // Position of stream in the member
+}
+
+// Name returns the archive:member name of the image
+func (m *archiveMember) Name() string {
+	return m.name
+}
+
+// ReadAt reads image data at the given offset
+func (m *archiveMember) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= m.Size() {
+		return 0, io.EOF
+	}
+	if m.stream == nil || off < m.pos {
+		if m.stream != nil {
+			m.stream.Close()
+		}
+		stream, err := m.file.Open()
+		if err != nil {
+			m.stream = nil
+			return 0, err
+		}
+		m.stream, m.pos = stream, 0
+	}
+	if off > m.pos {
+		skipped, err := io.CopyN(ioutil.Discard, m.stream, off-m.pos)
+		m.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	read, err := io.ReadFull(m.stream, p)
+	m.pos += int64(read)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// Size returns the length of the image, as the archive records it
+func (m *archiveMember) Size() int64 {
+	return int64(m.file.UncompressedSize64)
+}
+
+// Close closes the member, and the archive it came from
+func (m *archiveMember) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stream != nil {
+		m.stream.Close()
+		m.stream = nil
+	}
+	if m.archive != nil {
+		return m.archive.Close()
+	}
+	return nil
+}
+
+// openArchiveMember opens an image in a zip archive. If no member is
+// named, the archive must contain exactly one image.
+func openArchiveMember(archive, member string) (m *archiveMember, err error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive %s: %v", archive, err)
+	}
+	defer func() {
+		if m == nil {
+			reader.Close()
+		}
+	}()
+
+	if member == "" {
+		candidates, err := zipImages(&reader.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not list images in %s: %v", archive, err)
+		}
+		switch len(candidates) {
+		case 0:
+			return nil, fmt.Errorf("archive %s contains no disk images", archive)
+		case 1:
+			member = candidates[0]
+		default:
+			return nil, fmt.Errorf("archive %s contains %d images; choose one with %s%s<image>: %s",
+				archive, len(candidates), archive, archiveSeparator, strings.Join(candidates, ", "))
+		}
+	}
+
+	for _, f := range reader.File {
+		if f.Name != member {
+			continue
+		}
+		return &archiveMember{
+			name:    archive + archiveSeparator + member,
+			file:    f,
+			archive: reader,
+		}, nil
+	}
+	return nil, fmt.Errorf("archive %s has no member %s", archive, member)
+}
+
+// archiveImages returns the names of the members of a zip archive that
+// appear to be disk images.
+func archiveImages(archive string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive %s: %v", archive, err)
+	}
+	defer reader.Close()
+	return zipImages(&reader.Reader)
+}
+
+// zipImages returns the names of archive members that appear to be
+// disk images, either by content or by filename suffix. Only as much of
+// each member is decompressed as detecting its format reads, which is
+// usually just its header.
+func zipImages(reader *zip.Reader) ([]string, error) {
+	var candidates []string
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if diskimage.ForFilename(path.Base(f.Name)) != nil {
+			candidates = append(candidates, f.Name)
+			continue
+		}
+		m := &archiveMember{name: f.Name, file: f}
+		_, confidence := diskimage.Detect(m)
+		m.Close()
+		if confidence > diskimage.DetectMaybe {
+			candidates = append(candidates, f.Name)
+		}
+	}
+	return candidates, nil
+}
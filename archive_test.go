@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeZip writes an archive of the given members into dir
+func writeZip(t *testing.T, dir string, members map[string][]byte) string {
+	name := filepath.Join(dir, "images.zip")
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("could not create archive: %v", err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	for member, data := range members {
+		f, err := w.Create(member)
+		if err != nil {
+			t.Fatalf("could not add %s: %v", member, err)
+		}
+		f.Write(data)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not write archive: %v", err)
+	}
+	return name
+}
+
+func TestArchiveMember(t *testing.T) {
+	// A ProDOS volume with no telling suffix, found by its content
+	volume := streamData(280 * 512)
+	header := volume[2*512:]
+	header[0], header[1], header[4] = 0, 0, 0xf4
+	header[0x23], header[0x24] = 0x27, 0x0d
+	archive := writeZip(t, t.TempDir(), map[string][]byte{
+		"README.txt":   []byte("not a disk"),
+		"disks/one":    volume,
+		"disks/two.po": nil,
+	})
+
+	images, err := archiveImages(archive)
+	if err != nil {
+		t.Fatalf("could not list images: %v", err)
+	}
+	sort.Strings(images)
+	if expected := []string{"disks/one", "disks/two.po"}; !reflect.DeepEqual(images, expected) {
+		t.Errorf("images found %v, expected %v", images, expected)
+	}
+
+	m, err := openArchiveMember(archive, "disks/one")
+	if err != nil {
+		t.Fatalf("could not open member: %v", err)
+	}
+	defer m.Close()
+	if m.Size() != int64(len(volume)) {
+		t.Errorf("member size %d, expected %d", m.Size(), len(volume))
+	}
+	buf := make([]byte, 1024)
+	for _, off := range []int64{4096, 100 * 512, 0, 2048} {
+		if read, err := m.ReadAt(buf, off); err != nil || read != len(buf) {
+			t.Fatalf("read at %d returned %d bytes, %v", off, read, err)
+		}
+		if !bytes.Equal(buf, volume[off:off+int64(len(buf))]) {
+			t.Errorf("read at %d returned the wrong data", off)
+		}
+	}
+	if read, err := m.ReadAt(buf, int64(len(volume))-512); read != 512 || err != io.EOF {
+		t.Errorf("read across the end returned %d bytes, %v", read, err)
+	}
+
+	if _, err = openArchiveMember(archive, ""); err == nil {
+		t.Errorf("opened an archive of two images without naming one")
+	}
+}
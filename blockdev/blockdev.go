@@ -0,0 +1,164 @@
+// Package blockdev reads and writes block devices, such as a CF card in
+// a USB reader, as Microdrive/Turbo card images.
+//
+// Devices are read and written only in whole sectors at sector-aligned
+// offsets, as some devices require; a Device turns other reads and
+// writes into aligned ones, reading back any partial sectors to merge
+// in writes.
+package blockdev
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Is reports whether a file is a block device
+func Is(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// Device is an open block device
+type Device struct {
+	*os.File
+	size       int64
+	sectorSize int64
+}
+
+// Open opens a block device with the given flags, as for os.OpenFile,
+// and finds its size and sector size
+func Open(name string, flag int) (*Device, error) {
+	file, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !Is(fi) {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a block device", name)
+	}
+	d := &Device{File: file}
+	if d.size, err = size(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not get the size of %s: %v", name, err)
+	}
+	if d.sectorSize, err = sectorSize(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not get the sector size of %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// Size returns the size of the device in bytes
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// SectorSize returns the size of the device's logical sectors in bytes
+func (d *Device) SectorSize() int64 {
+	return d.sectorSize
+}
+
+// aligned returns the sector-aligned span covering length bytes at off
+func (d *Device) aligned(off int64, length int) (start, end int64) {
+	start = off - off%d.sectorSize
+	end = off + int64(length)
+	if rem := end % d.sectorSize; rem != 0 {
+		end += d.sectorSize - rem
+	}
+	return start, end
+}
+
+// ReadAt reads from the device, returning io.EOF at its end
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	var short error
+	if rest := d.size - off; int64(len(p)) > rest {
+		p, short = p[:rest], io.EOF
+	}
+	start, end := d.aligned(off, len(p))
+	if start == off && end == off+int64(len(p)) {
+		read, err := d.File.ReadAt(p, off)
+		if err == nil {
+			err = short
+		}
+		return read, err
+	}
+	buf := make([]byte, end-start)
+	if _, err := d.File.ReadAt(buf, start); err != nil {
+		return 0, err
+	}
+	return copy(p, buf[off-start:]), short
+}
+
+// WriteAt writes to the device, refusing to write past its end
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > d.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the device (%d bytes)", len(p), off, d.size)
+	}
+	start, end := d.aligned(off, len(p))
+	if start == off && end == off+int64(len(p)) {
+		return d.File.WriteAt(p, off)
+	}
+	// Merge the write into the sectors it covers
+	buf := make([]byte, end-start)
+	if _, err := d.File.ReadAt(buf, start); err != nil {
+		return 0, err
+	}
+	copy(buf[off-start:], p)
+	if _, err := d.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Mount is a mounted filesystem, from /proc/mounts
+type Mount struct {
+	Source string // Device or other source mounted
+	Dir    string // Where it's mounted
+}
+
+// parseMounts reads mounts in the format of /proc/mounts
+func parseMounts(r io.Reader) (mounts []Mount, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mounts = append(mounts, Mount{Source: unescape(fields[0]), Dir: unescape(fields[1])})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescape undoes the octal escapes /proc/mounts uses for spaces and
+// other awkward characters
+func unescape(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
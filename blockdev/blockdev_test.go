@@ -0,0 +1,75 @@
+package blockdev
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newDevice returns a Device backed by a temporary file, as no block
+// device is to hand
+func newDevice(t *testing.T, size, sectorSize int64) *Device {
+	file, err := ioutil.TempFile("", "blockdev")
+	if err != nil {
+		t.Fatalf("could not make temporary file: %v", err)
+	}
+	if _, err = file.Write(bytes.Repeat([]byte{0xee}, int(size))); err != nil {
+		t.Fatalf("could not fill temporary file: %v", err)
+	}
+	return &Device{File: file, size: size, sectorSize: sectorSize}
+}
+
+func TestUnalignedWrite(t *testing.T) {
+	d := newDevice(t, 8192, 4096)
+	defer os.Remove(d.Name())
+	defer d.Close()
+
+	data := bytes.Repeat([]byte{0x42}, 512)
+	if written, err := d.WriteAt(data, 4000); err != nil || written != len(data) {
+		t.Fatalf("unaligned write returned %d, %v", written, err)
+	}
+	contents, _ := ioutil.ReadFile(d.Name())
+	expected := bytes.Repeat([]byte{0xee}, 8192)
+	copy(expected[4000:], data)
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("unaligned write didn't keep the rest of its sectors")
+	}
+
+	if _, err := d.WriteAt(data, 8000); err == nil {
+		t.Errorf("write past the end of the device succeeded")
+	}
+}
+
+func TestUnalignedRead(t *testing.T) {
+	d := newDevice(t, 8192, 4096)
+	defer os.Remove(d.Name())
+	defer d.Close()
+	d.File.WriteAt([]byte{1, 2, 3}, 4095)
+
+	p := make([]byte, 3)
+	if read, err := d.ReadAt(p, 4095); err != nil || read != 3 || !bytes.Equal(p, []byte{1, 2, 3}) {
+		t.Errorf("unaligned read returned %v, %d, %v", p, read, err)
+	}
+	p = make([]byte, 100)
+	if read, err := d.ReadAt(p, 8150); err != io.EOF || read != 42 {
+		t.Errorf("read past the end returned %d, %v; expected 42, EOF", read, err)
+	}
+	if _, err := d.ReadAt(p, 8192); err != io.EOF {
+		t.Errorf("read at the end returned %v, expected EOF", err)
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	mounts, err := parseMounts(strings.NewReader(
+		"proc /proc proc rw,nosuid 0 0\n" +
+			"/dev/sdb1 /media/CF\\040Card vfat rw 0 0\n"))
+	if err != nil || len(mounts) != 2 {
+		t.Fatalf("parsed %+v, %v", mounts, err)
+	}
+	if mounts[1].Source != "/dev/sdb1" || mounts[1].Dir != "/media/CF Card" {
+		t.Errorf("mount parsed as %+v", mounts[1])
+	}
+}
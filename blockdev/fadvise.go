@@ -0,0 +1,26 @@
+//go:build linux && (amd64 || arm64 || riscv64)
+// +build linux
+// +build amd64 arm64 riscv64
+
+package blockdev
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadvDontNeed is POSIX_FADV_DONTNEED, from linux/fadvise.h
+const fadvDontNeed = 4
+
+// DropCache asks the kernel to forget its cached copy of a range of an
+// image file or device, so the range is next read from the card itself.
+// A length of 0 means to the end. Sync the range first, as changes not
+// yet written aren't dropped.
+func DropCache(file *os.File, offset, length int64) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(),
+		uintptr(offset), uintptr(length), fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 riscv64 s390x
+
+package blockdev
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctls from linux/fs.h, numbered as asm-generic/ioctl.h has it. Mips,
+// powerpc and sparc number them differently, so get noioctl.go instead.
+const blkSSZGet = 0x1268 // Logical sector size, as an int
+
+// blkGetSize64 gets the size in bytes, as a uint64. It's declared as
+// _IOR(0x12, 114, size_t), so its number depends on the size of size_t.
+var blkGetSize64 = ior(0x12, 114, unsafe.Sizeof(uintptr(0)))
+
+// ior encodes an ioctl that reads size bytes, like _IOR in
+// asm-generic/ioctl.h
+func ior(kind, number, size uintptr) uintptr {
+	const read = 2
+	return read<<30 | size<<16 | kind<<8 | number
+}
+
+// size asks the kernel for the size of a block device
+func size(file *os.File) (int64, error) {
+	var bytes uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&bytes)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(bytes), nil
+}
+
+// sectorSize asks the kernel for the logical sector size of a block
+// device
+func sectorSize(file *os.File) (int64, error) {
+	var bytes int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), blkSSZGet, uintptr(unsafe.Pointer(&bytes)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(bytes), nil
+}
@@ -0,0 +1,19 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 riscv64 s390x
+
+package blockdev
+
+import (
+	"testing"
+)
+
+func TestIOR(t *testing.T) {
+	// BLKGETSIZE64 with a 64 and a 32-bit size_t
+	if request := ior(0x12, 114, 8); request != 0x80081272 {
+		t.Errorf("64-bit BLKGETSIZE64 is %#x, expected 0x80081272", request)
+	}
+	if request := ior(0x12, 114, 4); request != 0x80041272 {
+		t.Errorf("32-bit BLKGETSIZE64 is %#x, expected 0x80041272", request)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package blockdev
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Mounted returns the mounts, listed in /proc/mounts, of a block device
+// or of any of its partitions
+func Mounted(name string) ([]Mount, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mounts, err := parseMounts(file)
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := deviceName(name)
+	if err != nil {
+		return nil, err
+	}
+	var found []Mount
+	for _, m := range mounts {
+		source, err := deviceName(m.Source)
+		if err != nil {
+			continue // Not a device, such as proc or tmpfs
+		}
+		// Partitions appear in sysfs under the disk they're on
+		if _, err = os.Stat(filepath.Join("/sys/class/block", disk, source)); source == disk || err == nil {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+// deviceName returns the kernel's name for a device node, such as sdb
+// for /dev/sdb or for a symlink to it such as /dev/disk/by-id/...
+func deviceName(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", os.ErrInvalid
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(resolved), nil
+}
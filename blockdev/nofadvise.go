@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64 || riscv64)
+// +build !linux !amd64,!arm64,!riscv64
+
+package blockdev
+
+import (
+	"errors"
+	"os"
+)
+
+// DropCache can't drop cached data on this system, so reading back what
+// was just written may not reach the card
+func DropCache(file *os.File, offset, length int64) error {
+	return errors.New("reading back past the cache isn't supported on this system")
+}
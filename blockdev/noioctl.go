@@ -0,0 +1,19 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build !linux !386,!amd64,!arm,!arm64,!loong64,!riscv64,!s390x
+
+package blockdev
+
+import (
+	"io"
+	"os"
+)
+
+// size finds the size of a block device by seeking to its end
+func size(file *os.File) (int64, error) {
+	return file.Seek(0, io.SeekEnd)
+}
+
+// sectorSize assumes 512 byte sectors, as there's no portable way to ask
+func sectorSize(file *os.File) (int64, error) {
+	return 512, nil
+}
@@ -0,0 +1,53 @@
+package blockdev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Disk is a whole disk found in sysfs
+type Disk struct {
+	Name      string // Kernel name, such as sdb
+	Path      string // Device node, such as /dev/sdb
+	Size      int64  // Size in bytes; 0 for a reader with no card in it
+	Model     string // Vendor and model, if known
+	Removable bool
+}
+
+// Disks lists the whole disks in a sysfs tree rooted at sysRoot,
+// normally /sys, with their device nodes in devRoot, normally /dev
+func Disks(sysRoot, devRoot string) (disks []Disk, err error) {
+	blockDir := filepath.Join(sysRoot, "block")
+	entries, err := ioutil.ReadDir(blockDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list disks: %v", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(blockDir, entry.Name())
+		disk := Disk{
+			Name:      entry.Name(),
+			Path:      filepath.Join(devRoot, entry.Name()),
+			Removable: readAttribute(dir, "removable") == "1",
+			Model: strings.TrimSpace(readAttribute(dir, "device/vendor") + " " +
+				readAttribute(dir, "device/model")),
+		}
+		// sysfs gives sizes in 512 byte units, whatever the sector size
+		if sectors, err := strconv.ParseInt(readAttribute(dir, "size"), 10, 64); err == nil {
+			disk.Size = sectors * 512
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// readAttribute returns a sysfs attribute, or "" if it can't be read
+func readAttribute(dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,55 @@
+package blockdev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAttributes makes a fake sysfs directory for a disk
+func writeAttributes(t *testing.T, dir string, attributes map[string]string) {
+	for name, value := range attributes {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("could not make %s: %v", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0666); err != nil {
+			t.Fatalf("could not write %s: %v", path, err)
+		}
+	}
+}
+
+func TestDisks(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	writeAttributes(t, filepath.Join(root, "block", "sda"), map[string]string{
+		"removable": "0",
+		"size":      "1000215216",
+	})
+	writeAttributes(t, filepath.Join(root, "block", "sdb"), map[string]string{
+		"removable":     "1",
+		"size":          "7831152",
+		"device/vendor": "SanDisk ",
+		"device/model":  "SDCFH-004G      ",
+	})
+
+	disks, err := Disks(root, "/dev")
+	if err != nil || len(disks) != 2 {
+		t.Fatalf("found disks %+v: %v", disks, err)
+	}
+	if disks[0].Removable || disks[0].Model != "" || disks[0].Size != 1000215216*512 {
+		t.Errorf("fixed disk read as %+v", disks[0])
+	}
+	expected := Disk{Name: "sdb", Path: "/dev/sdb", Size: 7831152 * 512, Model: "SanDisk SDCFH-004G", Removable: true}
+	if disks[1] != expected {
+		t.Errorf("CF card read as %+v, expected %+v", disks[1], expected)
+	}
+
+	if _, err = Disks(filepath.Join(root, "missing"), "/dev"); err == nil {
+		t.Errorf("missing sysfs tree listed without error")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/lock"
+)
+
+// lockCards locks the cards a command uses: exclusively for commands
+// that change a card, and shared for those that only read one, which
+// includes any command in a dry run. A card named more than once, as
+// by "sync card.mdt card.mdt", is locked once, exclusively if any use
+// changes it.
+func lockCards(command string) (locks []*lock.Lock, err error) {
+	var changed, read []string
+	switch command {
+	case "append":
+		changed = []string{cli.Append.Target}
+	case "applypatch":
+		changed = []string{cli.Applypatch.Target}
+	case "diff":
+		read = []string{cli.Diff.File1, cli.Diff.File2}
+	case "export":
+		read = []string{cli.Export.Source}
+	case "import":
+		// With a manifest, the only positional argument is the card
+		if cli.Import.Manifest != "" && cli.Import.Target == "" {
+			changed = []string{cli.Import.Source}
+		} else {
+			changed = []string{cli.Import.Target}
+		}
+	case "mkpatch":
+		read = []string{cli.Mkpatch.Old, cli.Mkpatch.New}
+	case "read":
+		read = []string{cli.Read.Image}
+	case "sync":
+		changed, read = []string{cli.Sync.Target}, []string{cli.Sync.Source}
+	case "undo":
+		if cli.Undo.List {
+			read = []string{cli.Undo.Target}
+		} else {
+			changed = []string{cli.Undo.Target}
+		}
+	case "write":
+		changed = []string{cli.Write.Image}
+	}
+	if cli.DryRun {
+		read, changed = append(read, changed...), nil
+	}
+
+	locked := make(map[string]bool)
+	for _, card := range changed {
+		if card == "" || locked[canonicalPath(card)] {
+			continue
+		}
+		locked[canonicalPath(card)] = true
+		l, err := lock.Exclusive(card, sidecarName(card, lock.Suffix), cli.Wait)
+		if err != nil {
+			releaseCards(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	for _, card := range read {
+		if card == "" || locked[canonicalPath(card)] {
+			continue
+		}
+		locked[canonicalPath(card)] = true
+		l, err := lock.Shared(card, sidecarName(card, lock.Suffix), cli.Wait)
+		if err != nil {
+			releaseCards(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+// releaseCards releases the locks taken by lockCards
+func releaseCards(locks []*lock.Lock) {
+	for _, l := range locks {
+		l.Release()
+	}
+}
+
+// canonicalPath returns the absolute path of a card with any symbolic
+// links resolved, so two names for the same card can be recognized
+func canonicalPath(card string) string {
+	if abs, err := filepath.Abs(card); err == nil {
+		card = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(card); err == nil {
+		card = resolved
+	}
+	return card
+}
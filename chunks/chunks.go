@@ -0,0 +1,152 @@
+// Package chunks compares a card image with a card in fixed-size
+// chunks, to find the parts that need writing to bring the card up to
+// date.
+//
+// A manifest of chunk hashes can be saved after each sync, so the next
+// one can tell what the card holds without reading all of it. It records
+// the size and modification time of the card too, so it isn't trusted
+// once anything else has written to the card.
+package chunks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Size is the default chunk size
+const Size = 64 * 1024
+
+// Manifest holds the hashes of the data on a card, chunk by chunk
+type Manifest struct {
+	Size      int64    `json:"size"`      // Bytes hashed
+	ChunkSize int64    `json:"chunkSize"` // Bytes per chunk; the last may be short
+	Hashes    []string `json:"hashes"`    // Hex SHA-256 of each chunk
+
+	CardSize int64     `json:"cardSize"` // Size of the card's file when stamped
+	Modified time.Time `json:"modified"` // Modification time of the card's file when stamped
+}
+
+// Stamp records the size and modification time of the card's file, as
+// given by fi, once the card holds what the manifest describes
+func (m *Manifest) Stamp(fi os.FileInfo) {
+	m.CardSize, m.Modified = fi.Size(), fi.ModTime()
+}
+
+// Load reads a manifest saved by Save
+func Load(filename string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("hash manifest %s is damaged: %v", filename, err)
+	}
+	if m.ChunkSize <= 0 || int64(len(m.Hashes)) != (m.Size+m.ChunkSize-1)/m.ChunkSize {
+		return nil, fmt.Errorf("hash manifest %s is damaged: wrong number of hashes", filename)
+	}
+	return &m, nil
+}
+
+// Save writes a manifest to a file
+func (m *Manifest) Save(filename string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0666)
+}
+
+// Matches checks a manifest can be trusted for a card, whose file has
+// info fi: the file must not have changed since the manifest was
+// stamped, and as a cheap guard against using it on the wrong card, the
+// first chunk must match
+func (m *Manifest) Matches(card io.ReaderAt, fi os.FileInfo) bool {
+	if len(m.Hashes) == 0 || m.Modified.IsZero() ||
+		fi.Size() != m.CardSize || !fi.ModTime().Equal(m.Modified) {
+		return false
+	}
+	length := m.ChunkSize
+	if m.Size < length {
+		length = m.Size
+	}
+	chunk := make([]byte, length)
+	if read, _ := card.ReadAt(chunk, 0); int64(read) != length {
+		return false
+	}
+	return hashOf(chunk) == m.Hashes[0]
+}
+
+// hashOf returns the hex SHA-256 of a chunk
+func hashOf(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// known returns the hash a manifest records for the chunk of length
+// bytes at offset, or "" if it doesn't have one for exactly that chunk
+func (m *Manifest) known(offset int64, length int) string {
+	if m == nil || offset%m.ChunkSize != 0 {
+		return ""
+	}
+	i := offset / m.ChunkSize
+	chunkLength := m.ChunkSize
+	if rest := m.Size - offset; rest < chunkLength {
+		chunkLength = rest
+	}
+	if i >= int64(len(m.Hashes)) || chunkLength != int64(length) {
+		return ""
+	}
+	return m.Hashes[i]
+}
+
+// Changed reads a card image from src to its end, comparing it with a
+// card chunk by chunk, and returns the offsets of the chunks that
+// differ, along with a manifest of the image. A chunk is looked up in
+// old, a manifest saved of the card, if that has it, and otherwise
+// read from the card. A card shorter than the image differs in every
+// chunk past its end. Stops between chunks if ctx is cancelled.
+func Changed(ctx context.Context, src io.Reader, card io.ReaderAt, old *Manifest, chunkSize int64) (changed []int64, m *Manifest, err error) {
+	if old != nil && old.ChunkSize != chunkSize {
+		old = nil
+	}
+	m = &Manifest{ChunkSize: chunkSize}
+	chunk := make([]byte, chunkSize)
+	onCard := make([]byte, chunkSize)
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		read, readErr := io.ReadFull(src, chunk)
+		if readErr == io.EOF {
+			return changed, m, nil
+		}
+		if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return nil, nil, readErr
+		}
+		hash := hashOf(chunk[:read])
+		if known := old.known(m.Size, read); known != "" {
+			if known != hash {
+				changed = append(changed, m.Size)
+			}
+		} else {
+			cardRead, cardErr := card.ReadAt(onCard[:read], m.Size)
+			if cardErr != nil && cardErr != io.EOF {
+				return nil, nil, fmt.Errorf("could not read card at %d: %v", m.Size, cardErr)
+			}
+			if cardRead != read || !bytes.Equal(chunk[:read], onCard[:read]) {
+				changed = append(changed, m.Size)
+			}
+		}
+		m.Hashes = append(m.Hashes, hash)
+		m.Size += int64(read)
+	}
+}
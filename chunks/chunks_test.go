@@ -0,0 +1,104 @@
+package chunks
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChanged(t *testing.T) {
+	image := bytes.Repeat([]byte{0x42}, 10*1000+500)
+	card := append([]byte(nil), image...)
+	card[2500] = 0      // Chunk 2
+	card[9999] = 0      // Chunk 9
+	card = card[:10200] // Chunk 10 is cut short
+
+	changed, m, err := Changed(context.Background(), bytes.NewReader(image), bytes.NewReader(card), nil, 1000)
+	if err != nil {
+		t.Fatalf("compare failed: %v", err)
+	}
+	if expected := []int64{2000, 9000, 10000}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("changed chunks %v, expected %v", changed, expected)
+	}
+	if m.Size != int64(len(image)) || len(m.Hashes) != 11 {
+		t.Errorf("manifest of %d bytes has %d hashes", m.Size, len(m.Hashes))
+	}
+
+	// With a manifest of the card as it now is, the card isn't read
+	changed, _, err = Changed(context.Background(), bytes.NewReader(image), bytes.NewReader(nil), m, 1000)
+	if err != nil || len(changed) != 0 {
+		t.Errorf("compare against manifest found %v changed: %v", changed, err)
+	}
+	image[5000] = 1
+	changed, _, err = Changed(context.Background(), bytes.NewReader(image), bytes.NewReader(nil), m, 1000)
+	if err != nil || !reflect.DeepEqual(changed, []int64{5000}) {
+		t.Errorf("compare against manifest found %v changed, expected [5000]: %v", changed, err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image := bytes.Repeat([]byte{7}, 2500)
+	_, m, err := Changed(context.Background(), bytes.NewReader(image), bytes.NewReader(image), nil, 1000)
+	if err != nil {
+		t.Fatalf("compare failed: %v", err)
+	}
+
+	card := filepath.Join(dir, "card.mdt")
+	if err = ioutil.WriteFile(card, image, 0666); err != nil {
+		t.Fatalf("could not write card: %v", err)
+	}
+	fi, err := os.Stat(card)
+	if err != nil {
+		t.Fatalf("could not stat card: %v", err)
+	}
+	if m.Matches(bytes.NewReader(image), fi) {
+		t.Errorf("unstamped manifest matches")
+	}
+	m.Stamp(fi)
+
+	filename := filepath.Join(dir, "card.hashes")
+	if err = m.Save(filename); err != nil {
+		t.Fatalf("could not save manifest: %v", err)
+	}
+	loaded, err := Load(filename)
+	if err != nil || !reflect.DeepEqual(loaded.Hashes, m.Hashes) || !loaded.Modified.Equal(m.Modified) {
+		t.Fatalf("loaded manifest %+v, expected %+v: %v", loaded, m, err)
+	}
+	if !loaded.Matches(bytes.NewReader(image), fi) {
+		t.Errorf("manifest doesn't match the card it was made from")
+	}
+
+	// Any later write to the card, even past the first chunk, changes
+	// its modification time
+	changed := time.Now().Add(time.Second)
+	if err = os.Chtimes(card, changed, changed); err != nil {
+		t.Fatalf("could not touch card: %v", err)
+	}
+	if fi, err = os.Stat(card); err != nil {
+		t.Fatalf("could not stat card: %v", err)
+	}
+	if loaded.Matches(bytes.NewReader(image), fi) {
+		t.Errorf("manifest matches a card written since")
+	}
+	loaded.Stamp(fi)
+	image[0] = 0
+	if loaded.Matches(bytes.NewReader(image), fi) {
+		t.Errorf("manifest matches a different card")
+	}
+
+	loaded.Hashes = loaded.Hashes[1:]
+	loaded.Save(filename)
+	if _, err = Load(filename); err == nil {
+		t.Errorf("manifest with missing hashes loaded without error")
+	}
+}
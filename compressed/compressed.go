@@ -0,0 +1,325 @@
+// Package compressed provides transparent access to gzip, bzip2 and xz
+// compressed disk images.
+//
+// Compressed streams can't be read at arbitrary offsets, so File
+// decompresses on the fly, and only rewinds to the start of the stream
+// when asked to read backwards. Reading the partition table or a
+// single partition therefore never needs more than one forward pass,
+// and never needs the whole image in memory or on disk.
+package compressed
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/ulikunitz/xz"
+)
+
+// Kind identifies a compression format
+type Kind int
+
+const (
+	// None is an uncompressed file
+	None Kind = iota
+	// Gzip is a gzip-compressed file
+	Gzip
+	// Bzip2 is a bzip2-compressed file
+	Bzip2
+	// XZ is an xz-compressed file
+	XZ
+)
+
+// SniffSize is the number of bytes Sniff needs to identify a format
+const SniffSize = 6
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXZ    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// String returns the name of the compression format
+func (k Kind) String() string {
+	switch k {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case XZ:
+		return "xz"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// ParseKind converts a compression format name into a Kind
+func ParseKind(name string) (Kind, error) {
+	switch strings.ToLower(name) {
+	case "none", "":
+		return None, nil
+	case "gzip", "gz":
+		return Gzip, nil
+	case "bzip2", "bz2":
+		return Bzip2, nil
+	case "xz":
+		return XZ, nil
+	default:
+		return None, fmt.Errorf("unknown compression format %s", name)
+	}
+}
+
+// Sniff identifies the compression format from the first bytes of a
+// file.
+func Sniff(header []byte) Kind {
+	switch {
+	case bytes.HasPrefix(header, magicGzip):
+		return Gzip
+	case bytes.HasPrefix(header, magicBzip2):
+		return Bzip2
+	case bytes.HasPrefix(header, magicXZ):
+		return XZ
+	default:
+		return None
+	}
+}
+
+// KindFromName identifies the compression format from a filename
+// suffix, for use when creating files.
+func KindFromName(name string) Kind {
+	_, kind := TrimSuffix(name)
+	return kind
+}
+
+// TrimSuffix removes any compression suffix from a filename, returning
+// the remaining name and the compression format the suffix implied.
+func TrimSuffix(name string) (string, Kind) {
+	lower := strings.ToLower(name)
+	for _, s := range []struct {
+		suffix string
+		kind   Kind
+	}{
+		{".gz", Gzip},
+		{".bz2", Bzip2},
+		{".xz", XZ},
+	} {
+		if strings.HasSuffix(lower, s.suffix) {
+			return name[:len(name)-len(s.suffix)], s.kind
+		}
+	}
+	return name, None
+}
+
+// NewReader returns a reader that decompresses r
+func NewReader(kind Kind, r io.Reader) (io.Reader, error) {
+	switch kind {
+	case None:
+		return r, nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Bzip2:
+		return bzip2.NewReader(r), nil
+	case XZ:
+		return xz.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unknown compression format %v", kind)
+	}
+}
+
+// nopWriteCloser adds a no-op Close to a Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewWriter returns a writer that compresses into w. The caller must
+// Close the result to flush it; closing does not close w. The standard
+// library has no bzip2 compressor, so bzip2 output is unsupported.
+func NewWriter(kind Kind, w io.Writer) (io.WriteCloser, error) {
+	switch kind {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case XZ:
+		return xz.NewWriter(w)
+	case Bzip2:
+		return nil, fmt.Errorf("writing bzip2 files is not supported")
+	default:
+		return nil, fmt.Errorf("unknown compression format %v", kind)
+	}
+}
+
+// File is an image opened for reading, decompressed on the fly if
+// required. It implements io.ReaderAt, and is safe to read from several
+// goroutines at once, though a compressed file has a single stream of
+// decompressed data: reads are taken in turn, and any read behind the
+// last one rewinds and decompresses again from the start of the file.
+type File struct {
+	src  io.ReaderAt // Underlying (compressed) data
+	name string
+	kind Kind
+
+	mu     sync.Mutex // Guards stream, pos and size
+	stream io.Reader  // Decompressing reader over src
+	pos    int64      // Position of stream in decompressed data
+	size   int64      // Decompressed size, or -1 if not yet known
+}
+
+// Open opens the named file for reading, detecting any compression
+// from its content.
+func Open(name string) (*File, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewFile(file, name)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewFile wraps src, detecting any compression from its content. If
+// src is an io.Closer, closing the File closes it.
+func NewFile(src io.ReaderAt, name string) (*File, error) {
+	f := &File{src: src, name: name, size: -1}
+
+	header := make([]byte, SniffSize)
+	read, err := src.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	f.kind = Sniff(header[:read])
+
+	if f.kind == None {
+		switch s := src.(type) {
+		case *os.File:
+			fi, err := s.Stat()
+			if err != nil {
+				return nil, err
+			}
+			f.size = fi.Size()
+		case interface{ Size() int64 }:
+			f.size = s.Size()
+		}
+		return f, nil
+	}
+	if err = f.rewind(); err != nil {
+		return nil, fmt.Errorf("could not read %s as %v: %v", name, f.kind, err)
+	}
+	return f, nil
+}
+
+// Name returns the name of the underlying file
+func (f *File) Name() string {
+	return f.name
+}
+
+// Kind returns the compression format of the file
+func (f *File) Kind() Kind {
+	return f.kind
+}
+
+// Close closes the underlying file, if it can be closed
+func (f *File) Close() error {
+	if closer, ok := f.src.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// rewind restarts decompression from the start of the file
+func (f *File) rewind() error {
+	stream, err := NewReader(f.kind, io.NewSectionReader(f.src, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+	f.stream = stream
+	f.pos = 0
+	return nil
+}
+
+// ReadAt reads len(p) bytes of decompressed data starting at off.
+// Sequential reads are efficient; reading backwards rewinds, and
+// decompresses again from the beginning of the file.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.kind == None {
+		return f.src.ReadAt(p, off)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if f.size >= 0 && off >= f.size {
+		return 0, io.EOF
+	}
+
+	if off < f.pos {
+		if err := f.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if off > f.pos {
+		skipped, err := io.CopyN(ioutil.Discard, f.stream, off-f.pos)
+		f.pos += skipped
+		if err == io.EOF {
+			f.size = f.pos
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	read, err := io.ReadFull(f.stream, p)
+	f.pos += int64(read)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		f.size = f.pos
+		err = io.EOF
+	}
+	return read, err
+}
+
+// KnownSize returns the decompressed size of the file if it is known
+// without further decompression, or -1 if it is not.
+func (f *File) KnownSize() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// Size returns the decompressed size of the file. For compressed files
+// whose size isn't yet known, this requires decompressing the rest of
+// the file once.
+func (f *File) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size >= 0 {
+		return f.size, nil
+	}
+	if f.kind == None {
+		return -1, fmt.Errorf("size of %s is unknown", f.name)
+	}
+	skipped, err := io.Copy(ioutil.Discard, f.stream)
+	f.pos += skipped
+	if err != nil {
+		return -1, err
+	}
+	f.size = f.pos
+	return f.size, nil
+}
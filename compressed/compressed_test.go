@@ -0,0 +1,122 @@
+package compressed
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testImage returns recognizable, moderately compressible test data
+func testImage() []byte {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	return data
+}
+
+func writeCompressed(t *testing.T, kind Kind, data []byte) string {
+	var buf bytes.Buffer
+	w, err := NewWriter(kind, &buf)
+	if err != nil {
+		t.Fatalf("could not create %v writer: %v", kind, err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("could not compress: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not flush compressor: %v", err)
+	}
+	name := filepath.Join(t.TempDir(), "image")
+	if err = ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write test file: %v", err)
+	}
+	return name
+}
+
+func TestReadAt(t *testing.T) {
+	data := testImage()
+	for _, kind := range []Kind{None, Gzip, XZ} {
+		t.Run(kind.String(), func(t *testing.T) {
+			f, err := Open(writeCompressed(t, kind, data))
+			if err != nil {
+				t.Fatalf("could not open: %v", err)
+			}
+			defer f.Close()
+			if f.Kind() != kind {
+				t.Errorf("sniffed %v, wanted %v", f.Kind(), kind)
+			}
+
+			// Forward, then backward, then past the end
+			for _, off := range []int64{0, 10240, 512} {
+				buf := make([]byte, 512)
+				if _, err := f.ReadAt(buf, off); err != nil {
+					t.Fatalf("read at %d: %v", off, err)
+				}
+				if !bytes.Equal(buf, data[off:off+512]) {
+					t.Errorf("read at %d returned wrong data", off)
+				}
+			}
+			buf := make([]byte, 1024)
+			read, err := f.ReadAt(buf, int64(len(data))-512)
+			if read != 512 || err != io.EOF {
+				t.Errorf("short read at end returned %d, %v", read, err)
+			}
+
+			size, err := f.Size()
+			if err != nil || size != int64(len(data)) {
+				t.Errorf("size returned %d, %v; wanted %d", size, err, len(data))
+			}
+		})
+	}
+}
+
+func TestConcurrentReadAt(t *testing.T) {
+	data := testImage()
+	f, err := Open(writeCompressed(t, Gzip, data))
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	defer f.Close()
+
+	// Readers going forwards and backwards at once each get their own
+	// data, whatever the other has done to the stream
+	var wg sync.WaitGroup
+	for _, offsets := range [][]int64{{0, 4096, 8192, 60000}, {60000, 30000, 512, 0}} {
+		wg.Add(1)
+		go func(offsets []int64) {
+			defer wg.Done()
+			for _, off := range offsets {
+				buf := make([]byte, 1024)
+				if _, err := f.ReadAt(buf, off); err != nil {
+					t.Errorf("read at %d: %v", off, err)
+				} else if !bytes.Equal(buf, data[off:off+1024]) {
+					t.Errorf("read at %d returned wrong data", off)
+				}
+			}
+		}(offsets)
+	}
+	wg.Wait()
+}
+
+func TestSniff(t *testing.T) {
+	if Sniff([]byte("BZh91AY")) != Bzip2 {
+		t.Errorf("bzip2 header not recognized")
+	}
+	if Sniff([]byte{0xca, 0xcc}) != None {
+		t.Errorf("partition table recognized as compressed")
+	}
+}
+
+func TestTrimSuffix(t *testing.T) {
+	name, kind := TrimSuffix("disk.po.GZ")
+	if name != "disk.po" || kind != Gzip {
+		t.Errorf("got %s, %v", name, kind)
+	}
+	if _, err := NewWriter(Bzip2, ioutil.Discard); err == nil {
+		t.Errorf("bzip2 writer unexpectedly supported")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// confirm asks the user a yes or no question on the terminal, and
+// returns true if they answer yes. If yes is already set, the question
+// isn't asked. Without a terminal to ask on, confirm fails.
+func confirm(question string, yes bool) (bool, error) {
+	if yes {
+		return true, nil
+	}
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("%s: no terminal to confirm on; use --yes", question)
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == io.EOF {
+		// No answer is no
+		fmt.Fprintln(os.Stderr)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/blockdev"
+)
+
+// isDevice reports whether filename is a block device, such as a CF
+// card in a USB reader
+func isDevice(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && blockdev.Is(fi)
+}
+
+// openDevice opens a block device as a card. Opening it for writing
+// needs --device, and is refused while it or any of its partitions are
+// mounted.
+func openDevice(filename string, flag int) (*blockdev.Device, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if !cli.Device {
+			return nil, fmt.Errorf("%s is a block device; give --device to change it", filename)
+		}
+		mounts, err := blockdev.Mounted(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not check whether %s is mounted: %v", filename, err)
+		}
+		if len(mounts) > 0 {
+			var where []string
+			for _, m := range mounts {
+				where = append(where, m.Source+" on "+m.Dir)
+			}
+			return nil, fmt.Errorf("%s is mounted (%s); unmount it first",
+				filename, strings.Join(where, ", "))
+		}
+		// The kernel also refuses an exclusive open of a device in use
+		flag |= os.O_EXCL
+	}
+	return blockdev.Open(filename, flag)
+}
+
+// cardFile is a card image or device opened for reading
+type cardFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openCardFile opens a card image or device for reading
+func openCardFile(filename string) (cardFile, error) {
+	if !isDevice(filename) {
+		return os.Open(filename)
+	}
+	device, err := openDevice(filename, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// sidecarName returns the name of a file kept beside a card, such as
+// its undo journal. For a device, it's kept in the user's cache
+// directory instead, since /dev is no place for it, named after the
+// device so that every path to it finds the same file.
+func sidecarName(card, suffix string) string {
+	if !isDevice(card) {
+		return card + suffix
+	}
+	if resolved, err := filepath.EvalSymlinks(card); err == nil {
+		card = resolved
+	}
+	if abs, err := filepath.Abs(card); err == nil {
+		card = abs
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "microdrive")
+	os.MkdirAll(dir, 0777)
+	name := strings.Replace(strings.TrimPrefix(card, "/"), "/", "_", -1)
+	return filepath.Join(dir, name+suffix)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/blockdev"
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// DevicesCmd lists the CF cards attached that hold Microdrive/Turbo
+// partition tables
+type DevicesCmd struct {
+	All   bool   `help:"Check every disk, not just removable ones" default:"false"`
+	Sysfs string `help:"Root of the sysfs tree to scan" default:"/sys"`
+	Dev   string `help:"Directory holding the device nodes" default:"/dev"`
+}
+
+func listDevices() error {
+	disks, err := blockdev.Disks(cli.Devices.Sysfs, cli.Devices.Dev)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 6, 0, 4, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintf(w, "Device\tSize\tModel\tPartitions\t\n")
+	found := 0
+	for _, disk := range disks {
+		if (!disk.Removable && !cli.Devices.All) || disk.Size == 0 {
+			continue
+		}
+		partMap, err := deviceTable(disk.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read %s: %v\n", disk.Path, err)
+			continue
+		}
+		if !partMap.Validate() {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", disk.Path, humanBytes(disk.Size),
+			disk.Model, partitionSummary(partMap))
+		found++
+	}
+	if found == 0 {
+		fmt.Fprintln(os.Stderr, "No Microdrive/Turbo cards found")
+		return nil
+	}
+	w.Flush()
+	fmt.Print(buf.String())
+	return nil
+}
+
+// deviceTable reads the partition table from sector 0 of a device
+func deviceTable(filename string) (mdturbo.MDTurbo, error) {
+	var sector [mdturbo.PartitionBlkLen]byte
+	device, err := openCardFile(filename)
+	if err != nil {
+		return mdturbo.MDTurbo{}, err
+	}
+	defer device.Close()
+	if _, err = device.ReadAt(sector[:], 0); err != nil {
+		return mdturbo.MDTurbo{}, err
+	}
+	return mdturbo.Deserialize(sector)
+}
+
+// partitionSummary describes the partitions in a table: how many there
+// are, and their sizes
+func partitionSummary(partMap mdturbo.MDTurbo) string {
+	var sizes []string
+	for num := uint8(0); num < partMap.PartCount(); num++ {
+		partition, err := partMap.GetPartition(num)
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, humanBytes(int64(partition.Length())*mdturbo.SectorSize))
+	}
+	return fmt.Sprintf("%d: %s", len(sizes), strings.Join(sizes, ", "))
+}
@@ -3,15 +3,29 @@ package main
 
 import "fmt"
 
+import "github.com/disappearinjon/microdrive/mdturbo"
 import "gopkg.in/d4l3k/messagediff.v1"
 
 // DiffCmd contains the CLI args and flags for Diff command
 type DiffCmd struct {
-	File1 string `arg:"positional,required" help:"First Microdrive/Turbo image file"`
-	File2 string `arg:"positional, required"  help:"Second Microdrive/Turbo image file"`
+	File1  string `arg:"positional,required" help:"First Microdrive/Turbo image file"`
+	File2  string `arg:"positional, required"  help:"Second Microdrive/Turbo image file"`
+	Data   bool   `help:"Compare the contents of each partition too, block by block" default:"false"`
+	Files  bool   `help:"Compare the ProDOS files in each partition too" default:"false"`
+	Output string `arg:"-o" help:"Output format: text, or json with --files alone" default:"text"`
 }
 
 func diffPartitions() (err error) {
+	switch cli.Diff.Output {
+	case "text":
+	case "json":
+		if !cli.Diff.Files || cli.Diff.Data {
+			return fmt.Errorf("json output is only supported with --files, and without --data")
+		}
+	default:
+		return fmt.Errorf("unknown output format %s", cli.Diff.Output)
+	}
+
 	pt1, err := GetPartitionTable(cli.Diff.File1)
 	if err != nil {
 		return
@@ -21,10 +35,30 @@ func diffPartitions() (err error) {
 		return
 	}
 
-	diff, equal := messagediff.PrettyDiff(pt1, pt2)
+	if cli.Diff.Output == "json" {
+		return diffFiles(pt1, pt2)
+	}
+
+	diff, equal := tableDiff(pt1, pt2)
 	if !equal {
 		fmt.Println(diff)
+	} else if cli.Diff.Data || cli.Diff.Files {
+		fmt.Println("Partition table: identical")
 	}
 
+	if cli.Diff.Data {
+		if err = diffData(pt1, pt2); err != nil {
+			return
+		}
+	}
+	if cli.Diff.Files {
+		return diffFiles(pt1, pt2)
+	}
 	return
 }
+
+// tableDiff describes the differences between two partition tables,
+// returning true if there are none
+func tableDiff(pt1, pt2 mdturbo.MDTurbo) (string, bool) {
+	return messagediff.PrettyDiff(pt1, pt2)
+}
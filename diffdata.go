@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+)
+
+// maxRanges is how many ranges of differing blocks are listed for each
+// partition or file
+const maxRanges = 20
+
+// diffData compares the contents of each partition of two cards, and
+// reports the blocks that differ, and the ProDOS files holding them
+func diffData(pt1, pt2 mdturbo.MDTurbo) error {
+	card1, err := openCardImage(cli.Diff.File1)
+	if err != nil {
+		return err
+	}
+	defer card1.Close()
+	card2, err := openCardImage(cli.Diff.File2)
+	if err != nil {
+		return err
+	}
+	defer card2.Close()
+
+	count := pt1.PartCount()
+	if pt2.PartCount() > count {
+		count = pt2.PartCount()
+	}
+	for num := uint8(0); num < count; num++ {
+		switch {
+		case num >= pt1.PartCount():
+			fmt.Printf("Partition %d: only in %s\n", num, cli.Diff.File2)
+			continue
+		case num >= pt2.PartCount():
+			fmt.Printf("Partition %d: only in %s\n", num, cli.Diff.File1)
+			continue
+		}
+		part1, err := partitionReader(card1, pt1, num)
+		if err != nil {
+			return err
+		}
+		part2, err := partitionReader(card2, pt2, num)
+		if err != nil {
+			return err
+		}
+		if err = diffPartition(num, part1, part2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionReader returns a reader for a partition of a card
+func partitionReader(card io.ReaderAt, partMap mdturbo.MDTurbo, num uint8) (*io.SectionReader, error) {
+	partition, err := partMap.GetPartition(num)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(card, int64(partition.Start)*mdturbo.SectorSize,
+		int64(partition.Length())*mdturbo.SectorSize), nil
+}
+
+// diffPartition compares one partition of each card
+func diffPartition(num uint8, part1, part2 *io.SectionReader) error {
+	length := part1.Size()
+	if part2.Size() < length {
+		length = part2.Size()
+	}
+	blocks, err := differingBlocks(part1, part2, length)
+	if err != nil {
+		return fmt.Errorf("could not compare partition %d: %v", num, err)
+	}
+	var sizes string
+	if part1.Size() != part2.Size() {
+		sizes = fmt.Sprintf(" (sizes differ, %dK and %dK; compared the first %dK)",
+			part1.Size()/1024, part2.Size()/1024, length/1024)
+	}
+	if len(blocks) == 0 {
+		if sizes == "" {
+			fmt.Printf("Partition %d: identical\n", num)
+		} else {
+			fmt.Printf("Partition %d: no blocks differ%s\n", num, sizes)
+		}
+		return nil
+	}
+	fmt.Printf("Partition %d: %d of %d blocks differ%s: %s\n", num, len(blocks),
+		length/mdturbo.SectorSize, sizes, blockRanges(blocks))
+
+	// Say which files the blocks belong to, if both sides are ProDOS
+	owners1, err1 := prodos.Owners(part1)
+	owners2, err2 := prodos.Owners(part2)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	var names []string
+	byOwner := map[string][]int{}
+	for _, block := range blocks {
+		for _, owner := range blockOwners(block, owners1, owners2) {
+			if _, ok := byOwner[owner]; !ok {
+				names = append(names, owner)
+			}
+			byOwner[owner] = append(byOwner[owner], block)
+		}
+	}
+	for _, name := range names {
+		fmt.Printf("    %s: %s\n", name, blockRanges(byOwner[name]))
+	}
+	return nil
+}
+
+// blockOwners returns what a block holds on each side, once if it's the
+// same on both
+func blockOwners(block int, owners1, owners2 []string) []string {
+	owner := func(owners []string) string {
+		if block < len(owners) && owners[block] != "" {
+			return owners[block]
+		}
+		return "unused blocks"
+	}
+	if o1, o2 := owner(owners1), owner(owners2); o1 != o2 {
+		return []string{o1, o2}
+	}
+	return []string{owner(owners1)}
+}
+
+// differingBlocks compares the first length bytes of two partitions,
+// and returns the numbers of the blocks that differ
+func differingBlocks(part1, part2 io.ReaderAt, length int64) (blocks []int, err error) {
+	buf1 := make([]byte, 64*1024)
+	buf2 := make([]byte, len(buf1))
+	for offset := int64(0); offset < length; offset += int64(len(buf1)) {
+		chunk1, chunk2 := buf1, buf2
+		if rest := length - offset; rest < int64(len(chunk1)) {
+			chunk1, chunk2 = chunk1[:rest], chunk2[:rest]
+		}
+		if _, err = part1.ReadAt(chunk1, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if _, err = part2.ReadAt(chunk2, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.Equal(chunk1, chunk2) {
+			continue
+		}
+		for start := 0; start < len(chunk1); start += mdturbo.SectorSize {
+			end := start + mdturbo.SectorSize
+			if end > len(chunk1) {
+				end = len(chunk1)
+			}
+			if !bytes.Equal(chunk1[start:end], chunk2[start:end]) {
+				blocks = append(blocks, int(offset/mdturbo.SectorSize)+start/mdturbo.SectorSize)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// blockRanges formats a sorted list of block numbers as ranges, such as
+// "7, 10-20", listing only the first few
+func blockRanges(blocks []int) string {
+	var ranges []string
+	for i := 0; i < len(blocks); {
+		j := i
+		for j+1 < len(blocks) && blocks[j+1] == blocks[j]+1 {
+			j++
+		}
+		if j == i {
+			ranges = append(ranges, fmt.Sprintf("%d", blocks[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", blocks[i], blocks[j]))
+		}
+		i = j + 1
+	}
+	if len(ranges) > maxRanges {
+		more := len(ranges) - maxRanges
+		ranges = append(ranges[:maxRanges], fmt.Sprintf("and %d more", more))
+	}
+	return strings.Join(ranges, ", ")
+}
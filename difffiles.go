@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+)
+
+// fileSummary describes a file on one card
+type fileSummary struct {
+	prodos.File
+	TypeName string `json:"typeName"`
+	SHA256   string `json:"sha256,omitempty"` // Of the data fork; empty for directories
+}
+
+// fileChange is a file added, removed or modified between two cards
+type fileChange struct {
+	Path    string       `json:"path"` // Within the volume, such as GAMES/ZORK1
+	Change  string       `json:"change"`
+	Before  *fileSummary `json:"before,omitempty"`
+	After   *fileSummary `json:"after,omitempty"`
+	Differs []string     `json:"differs,omitempty"` // What was modified: type, size, date, contents
+}
+
+// partitionFiles is the comparison of the files in one partition of
+// each card
+type partitionFiles struct {
+	Partition int          `json:"partition"`
+	Volume1   string       `json:"volume1,omitempty"`
+	Volume2   string       `json:"volume2,omitempty"`
+	Skipped   string       `json:"skipped,omitempty"` // Why the files weren't compared
+	Changes   []fileChange `json:"changes"`
+}
+
+// diffFiles compares the ProDOS files in each partition of two cards,
+// printing the files added, removed and modified
+func diffFiles(pt1, pt2 mdturbo.MDTurbo) error {
+	card1, err := openCardImage(cli.Diff.File1)
+	if err != nil {
+		return err
+	}
+	defer card1.Close()
+	card2, err := openCardImage(cli.Diff.File2)
+	if err != nil {
+		return err
+	}
+	defer card2.Close()
+
+	count := pt1.PartCount()
+	if pt2.PartCount() > count {
+		count = pt2.PartCount()
+	}
+	results := []partitionFiles{}
+	for num := uint8(0); num < count; num++ {
+		result := partitionFiles{Partition: int(num), Changes: []fileChange{}}
+		switch {
+		case num >= pt1.PartCount():
+			result.Skipped = "only in " + cli.Diff.File2
+		case num >= pt2.PartCount():
+			result.Skipped = "only in " + cli.Diff.File1
+		default:
+			part1, err := partitionReader(card1, pt1, num)
+			if err != nil {
+				return err
+			}
+			part2, err := partitionReader(card2, pt2, num)
+			if err != nil {
+				return err
+			}
+			compareCatalogs(&result, part1, part2)
+		}
+		results = append(results, result)
+	}
+
+	if cli.Diff.Output == "json" {
+		marshaled, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v\n", string(marshaled))
+		return nil
+	}
+	for _, result := range results {
+		printPartitionFiles(result)
+	}
+	return nil
+}
+
+// compareCatalogs fills in the changes between the files of two
+// partitions, or why they couldn't be compared
+func compareCatalogs(result *partitionFiles, part1, part2 io.ReaderAt) {
+	vol1, err1 := prodos.ReadVolume(part1)
+	vol2, err2 := prodos.ReadVolume(part2)
+	switch {
+	case err1 != nil && err2 != nil:
+		result.Skipped = "not ProDOS on either card"
+		return
+	case err1 != nil:
+		result.Skipped = "not ProDOS in " + cli.Diff.File1
+		return
+	case err2 != nil:
+		result.Skipped = "not ProDOS in " + cli.Diff.File2
+		return
+	}
+	result.Volume1, result.Volume2 = vol1.Name, vol2.Name
+	before := catalogByPath(part1, vol1.Name, cli.Diff.File1)
+	after := catalogByPath(part2, vol2.Name, cli.Diff.File2)
+
+	for path, old := range before {
+		newer, ok := after[path]
+		if !ok {
+			result.Changes = append(result.Changes, fileChange{Path: path, Change: "removed", Before: old})
+			continue
+		}
+		if differs := fileDifferences(old, newer); len(differs) > 0 {
+			result.Changes = append(result.Changes, fileChange{
+				Path: path, Change: "modified", Before: old, After: newer, Differs: differs,
+			})
+		}
+	}
+	for path, newer := range after {
+		if _, ok := before[path]; !ok {
+			result.Changes = append(result.Changes, fileChange{Path: path, Change: "added", After: newer})
+		}
+	}
+	sort.Slice(result.Changes, func(i, j int) bool {
+		return result.Changes[i].Path < result.Changes[j].Path
+	})
+}
+
+// catalogByPath lists the files on a volume by their path within it,
+// with a hash of each file's contents
+func catalogByPath(part io.ReaderAt, volume, cardFile string) map[string]*fileSummary {
+	files, err := prodos.Catalog(part)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: could not read the catalog of /%s in %s: %v\n", volume, cardFile, err)
+	}
+	byPath := map[string]*fileSummary{}
+	for _, f := range files {
+		summary := &fileSummary{File: f, TypeName: prodos.TypeName(f.Type)}
+		if !f.IsDir() {
+			data, err := prodos.ReadFile(part, f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: could not read %s in %s: %v\n", f.Path, cardFile, err)
+			} else {
+				sum := sha256.Sum256(data)
+				summary.SHA256 = hex.EncodeToString(sum[:])
+			}
+		}
+		byPath[strings.TrimPrefix(f.Path, "/"+volume+"/")] = summary
+	}
+	return byPath
+}
+
+// fileDifferences lists what differs between two versions of a file.
+// A directory changes whenever its contents do, so only its type counts.
+func fileDifferences(old, newer *fileSummary) (differs []string) {
+	if old.Type != newer.Type || old.AuxType != newer.AuxType || old.IsDir() != newer.IsDir() {
+		differs = append(differs, "type")
+	}
+	if old.IsDir() || newer.IsDir() {
+		return differs
+	}
+	if old.Size != newer.Size {
+		differs = append(differs, "size")
+	}
+	if !old.Modified.Equal(newer.Modified) {
+		differs = append(differs, "date")
+	}
+	if old.SHA256 != newer.SHA256 {
+		differs = append(differs, "contents")
+	}
+	return differs
+}
+
+// describeFile summarizes a file for text output
+func describeFile(f *fileSummary) string {
+	if f.IsDir() {
+		return "directory"
+	}
+	description := fmt.Sprintf("%s, %d bytes", f.TypeName, f.Size)
+	if !f.Modified.IsZero() {
+		description += ", " + f.Modified.Format("2006-01-02 15:04")
+	}
+	return description
+}
+
+// printPartitionFiles prints the file changes in a partition as text
+func printPartitionFiles(result partitionFiles) {
+	switch {
+	case result.Skipped != "":
+		fmt.Printf("Partition %d: skipped; %s\n", result.Partition, result.Skipped)
+		return
+	case len(result.Changes) == 0:
+		fmt.Printf("Partition %d (/%s, /%s): no files differ\n", result.Partition, result.Volume1, result.Volume2)
+		return
+	}
+	fmt.Printf("Partition %d (/%s, /%s):\n", result.Partition, result.Volume1, result.Volume2)
+	for _, c := range result.Changes {
+		switch c.Change {
+		case "added":
+			fmt.Printf("    added     %s (%s)\n", c.Path, describeFile(c.After))
+		case "removed":
+			fmt.Printf("    removed   %s (%s)\n", c.Path, describeFile(c.Before))
+		default:
+			fmt.Printf("    modified  %s: %s\n", c.Path, strings.Join(c.Differs, ", "))
+			fmt.Printf("              was %s; now %s\n", describeFile(c.Before), describeFile(c.After))
+		}
+	}
+}
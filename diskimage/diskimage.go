@@ -0,0 +1,248 @@
+// Package diskimage provides a registry of Apple II disk image formats.
+//
+// Each format can recognize its images from their content, open them
+// for reading as a ProDOS-ordered block device, and create new images
+// from block data. Formats built into this package cover 2MG, DiskCopy
+// 4.2, DOS- and ProDOS-ordered raw images, WOZ, whole Microdrive/Turbo
+// images and gzip, bzip2 and xz compression; other formats can be added
+// with Register.
+package diskimage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/compressed"
+)
+
+// ImageFormat is a disk image type that can be recognized from its
+// content, read as a block device, and created.
+type ImageFormat interface {
+	// Name returns the short name of the format, as used to choose
+	// it explicitly. It should also be the format's usual filename
+	// suffix, as filenames are matched against format names.
+	Name() string
+
+	// Description returns a human-readable name for the format
+	Description() string
+
+	// Detect returns how confident the format is, from DetectNo to
+	// DetectSure, that r holds an image in this format.
+	Detect(r io.ReaderAt) int
+
+	// Open returns the disk data of the image in r as a block
+	// device, in ProDOS block order.
+	Open(r io.ReaderAt) (Device, error)
+
+	// Create writes a new image of the given disk data length to w.
+	// Disk data is written, in ProDOS block order, to the returned
+	// writer, which must be closed to finish the image; closing it
+	// does not close w. Formats which can't be written return
+	// ErrNotSupported.
+	Create(w io.Writer, length int64) (io.WriteCloser, error)
+}
+
+// Device is the disk data of an opened image
+type Device struct {
+	io.ReaderAt
+	Length int64 // Length in bytes; -1 if unknown without reading it all
+}
+
+// Confidence levels returned by ImageFormat.Detect
+const (
+	DetectNo     = 0   // Definitely not this format
+	DetectMaybe  = 10  // Plausible, e.g. the size is right
+	DetectLikely = 50  // Magic numbers match, but the header is odd
+	DetectSure   = 100 // Magic numbers and header check out
+)
+
+// ErrNotSupported is returned by formats that can't perform an operation
+var ErrNotSupported = errors.New("not supported for this image format")
+
+// BlockSize is the size of a ProDOS block
+const BlockSize = 512
+
+var (
+	registryLock sync.RWMutex
+	formats      []ImageFormat
+	aliases      = make(map[string]string)
+)
+
+// Register adds an image format to the registry. Formats registered
+// later take precedence when detection confidence is tied. Register
+// panics if a format of the same name is already registered.
+func Register(format ImageFormat) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	name := strings.ToLower(format.Name())
+	for _, f := range formats {
+		if strings.ToLower(f.Name()) == name {
+			panic("diskimage: format " + name + " registered twice")
+		}
+	}
+	formats = append(formats, format)
+}
+
+// RegisterAlias adds an alternate name, or filename suffix, for a
+// registered format.
+func RegisterAlias(alias, name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	aliases[strings.ToLower(alias)] = strings.ToLower(name)
+}
+
+// Formats returns all registered formats
+func Formats() []ImageFormat {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return append([]ImageFormat(nil), formats...)
+}
+
+// Lookup finds a registered format by name or alias, returning nil if
+// there is none.
+func Lookup(name string) ImageFormat {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	name = strings.ToLower(name)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	for _, format := range formats {
+		if strings.ToLower(format.Name()) == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// ForFilename finds a registered format by filename suffix, ignoring
+// any compression suffix. Returns nil if there is none.
+func ForFilename(filename string) ImageFormat {
+	filename, _ = compressed.TrimSuffix(filepath.Base(filename))
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		return nil
+	}
+	return Lookup(ext[1:])
+}
+
+// Detect returns the registered format most confident that it matches
+// r, and its confidence. Returns nil if no format matches.
+func Detect(r io.ReaderAt) (best ImageFormat, confidence int) {
+	for _, format := range Formats() {
+		if c := format.Detect(r); c >= confidence && c > DetectNo {
+			best, confidence = format, c
+		}
+	}
+	return
+}
+
+// Image is an image opened through the registry
+type Image struct {
+	Device
+	Format      ImageFormat // Format of the disk data
+	Description string      // Format description, including compression
+}
+
+// Open opens the image in r as the named format. When formatName is
+// "auto", the format is detected from the content, falling back to the
+// filename suffix of name. Compression is always removed first.
+func Open(r io.ReaderAt, name, formatName string) (img Image, err error) {
+	var layers []string
+
+	// Peel off any compression
+	for {
+		format, _ := Detect(r)
+		container, ok := format.(*compressedFormat)
+		if !ok {
+			break
+		}
+		device, err := container.Open(r)
+		if err != nil {
+			return img, fmt.Errorf("could not decompress %s: %v", name, err)
+		}
+		r = device.ReaderAt
+		layers = append(layers, container.Name())
+	}
+
+	var format ImageFormat
+	if strings.ToLower(formatName) == "auto" {
+		var confidence int
+		format, confidence = Detect(r)
+		if confidence <= DetectMaybe && len(layers) > 0 {
+			// Some formats can only be recognized by size, which
+			// for compressed images means decompressing once
+			if _, err = Size(r); err != nil {
+				return img, fmt.Errorf("could not decompress %s: %v", name, err)
+			}
+			format, _ = Detect(r)
+		}
+		if format == nil {
+			format = ForFilename(name)
+		}
+		if format == nil {
+			return img, fmt.Errorf("could not detect the image format of %s", name)
+		}
+	} else {
+		format = Lookup(formatName)
+		if format == nil {
+			return img, fmt.Errorf("unknown image format %s", formatName)
+		}
+	}
+
+	img.Format = format
+	img.Description = format.Description()
+	for i := len(layers) - 1; i >= 0; i-- {
+		img.Description += ", " + layers[i] + " compressed"
+	}
+	img.Device, err = format.Open(r)
+	if err != nil {
+		return img, fmt.Errorf("could not open %s as %s: %v", name, format.Description(), err)
+	}
+	return img, nil
+}
+
+// Size returns the size of the data behind an io.ReaderAt, which must
+// be an *os.File or have a Size method.
+func Size(r io.ReaderAt) (int64, error) {
+	switch s := r.(type) {
+	case *os.File:
+		fi, err := s.Stat()
+		if err != nil {
+			return -1, err
+		}
+		return fi.Size(), nil
+	case interface{ Size() int64 }:
+		return s.Size(), nil
+	case interface{ Size() (int64, error) }:
+		return s.Size()
+	default:
+		return -1, fmt.Errorf("image size is unknown")
+	}
+}
+
+// DetectSize returns the size of the data behind an io.ReaderAt if it
+// can be found cheaply, or -1 if not. Detect implementations should use
+// this rather than Size, as detection must never decompress a whole
+// card image just to learn its size.
+func DetectSize(r io.ReaderAt) int64 {
+	switch s := r.(type) {
+	case interface{ KnownSize() int64 }:
+		return s.KnownSize()
+	case *os.File, interface{ Size() int64 }:
+		size, err := Size(r)
+		if err != nil {
+			return -1
+		}
+		return size
+	default:
+		return -1
+	}
+}
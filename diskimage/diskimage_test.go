@@ -0,0 +1,201 @@
+package diskimage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testDisk returns ProDOS-ordered disk data with a volume directory
+// header, so every block is recognizable
+func testDisk(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i/BlockSize) ^ byte(i)
+	}
+	header := data[2*BlockSize:]
+	header[0], header[1] = 0, 0
+	header[0x04] = 0xf5
+	header[0x23], header[0x24] = 0x27, 0x0d
+	return data
+}
+
+// create writes data as a new image of the named format
+func create(t *testing.T, name string, data []byte) []byte {
+	format := Lookup(name)
+	if format == nil {
+		t.Fatalf("format %s is not registered", name)
+	}
+	var buf bytes.Buffer
+	w, err := format.Create(&buf, int64(len(data)))
+	if err != nil {
+		t.Fatalf("could not create %s image: %v", name, err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("could not write %s image: %v", name, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("could not finish %s image: %v", name, err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		length int
+		header map[int]byte // Bytes expected at these offsets of the image
+	}{
+		{"po", 32 * 1024, nil},
+		{"hdv", 32 * 1024, nil},
+		{"do", diskSize525, nil},
+		{"2mg", 32 * 1024, nil},
+		{"dc", 400 * 1024, map[int]byte{dcDiskFormatOff: 0, dcFormatByteOff: 0x12}},
+		{"dc", 800 * 1024, map[int]byte{dcDiskFormatOff: 1, dcFormatByteOff: 0x24}},
+	} {
+		data := testDisk(tc.length)
+		image := create(t, tc.format, data)
+		for off, expected := range tc.header {
+			if image[off] != expected {
+				t.Errorf("%s: header byte %#x is %#02x, expected %#02x", tc.format, off, image[off], expected)
+			}
+		}
+
+		img, err := Open(bytes.NewReader(image), "test", "auto")
+		if err != nil {
+			t.Errorf("%s: could not open: %v", tc.format, err)
+			continue
+		}
+		if img.Format != Lookup(tc.format) {
+			t.Errorf("%s: detected as %s", tc.format, img.Format.Name())
+		}
+		if img.Length != int64(tc.length) {
+			t.Errorf("%s: length %d, expected %d", tc.format, img.Length, tc.length)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, int64(tc.length)))
+		if err != nil {
+			t.Errorf("%s: could not read: %v", tc.format, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: data differs after round trip", tc.format)
+		}
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	data := testDisk(diskSize525)
+	image := create(t, "xz", create(t, "do", data))
+
+	img, err := Open(bytes.NewReader(image), "test.do.xz", "auto")
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	if img.Format.Name() != "do" {
+		t.Errorf("detected as %s, expected do", img.Format.Name())
+	}
+	if img.Description != "DOS-order 5.25\" image, xz compressed" {
+		t.Errorf("unexpected description %q", img.Description)
+	}
+	got, err := ioutil.ReadAll(io.NewSectionReader(img, 0, diskSize525))
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("data differs after round trip")
+	}
+}
+
+func TestCreateLength(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := Lookup("po").Create(&buf, 1024)
+	if err != nil {
+		t.Fatalf("could not create: %v", err)
+	}
+	w.Write(make([]byte, 512))
+	if w.Close() == nil {
+		t.Errorf("short image closed without error")
+	}
+	if _, err = Lookup("dc").Create(&buf, 1024); err == nil {
+		t.Errorf("DiskCopy accepted an odd size")
+	}
+	if _, err = Lookup("woz").Create(&buf, 1024); err != ErrNotSupported {
+		t.Errorf("WOZ create returned %v, expected ErrNotSupported", err)
+	}
+}
+
+func TestForFilename(t *testing.T) {
+	for name, expected := range map[string]string{
+		"disk.po":       "po",
+		"DISK.HDV":      "po",
+		"games.dsk.gz":  "do",
+		"system.2mg.xz": "2mg",
+		"nosuffix":      "",
+		"notes.txt":     "",
+	} {
+		format := ForFilename(name)
+		switch {
+		case format == nil && expected != "":
+			t.Errorf("%s: no format, expected %s", name, expected)
+		case format != nil && format.Name() != expected:
+			t.Errorf("%s: format %s, expected %s", name, format.Name(), expected)
+		}
+	}
+}
+
+// testFormat is an in-house format: raw blocks after a magic number
+type testFormat struct{}
+
+var testMagic = []byte("TEST")
+
+func (testFormat) Name() string        { return "tst" }
+func (testFormat) Description() string { return "test image" }
+
+func (testFormat) Detect(r io.ReaderAt) int {
+	if header := readHeader(r, len(testMagic)); bytes.Equal(header, testMagic) {
+		return DetectSure
+	}
+	return DetectNo
+}
+
+func (testFormat) Open(r io.ReaderAt) (Device, error) {
+	size, err := Size(r)
+	if err != nil {
+		return Device{}, err
+	}
+	length := size - int64(len(testMagic))
+	return Device{io.NewSectionReader(r, int64(len(testMagic)), length), length}, nil
+}
+
+func (testFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	if _, err := w.Write(testMagic); err != nil {
+		return nil, err
+	}
+	return &lengthWriter{w, length}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register(testFormat{})
+	RegisterAlias("test", "tst")
+
+	data := testDisk(4 * BlockSize)
+	image := create(t, "test", data)
+	img, err := Open(bytes.NewReader(image), "image", "auto")
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	if img.Format.Name() != "tst" || img.Length != int64(len(data)) {
+		t.Errorf("opened as %s of %d bytes", img.Format.Name(), img.Length)
+	}
+	if ForFilename("disk.tst") == nil {
+		t.Errorf("registered format not found by filename")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a duplicate name did not panic")
+		}
+	}()
+	Register(testFormat{})
+}
@@ -0,0 +1,492 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/compressed"
+	"github.com/disappearinjon/microdrive/h2mg"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/woz"
+)
+
+func init() {
+	Register(&compressedFormat{compressed.Gzip})
+	Register(&compressedFormat{compressed.Bzip2})
+	Register(&compressedFormat{compressed.XZ})
+	Register(prodosOrderFormat{})
+	Register(dosOrderFormat{})
+	Register(diskCopyFormat{})
+	Register(wozFormat{})
+	Register(h2mgFormat{})
+	Register(mdtFormat{})
+
+	RegisterAlias("gz", "gzip")
+	RegisterAlias("bz2", "bzip2")
+	RegisterAlias("hdv", "po")
+	RegisterAlias("dsk", "do")
+	RegisterAlias("dc42", "dc")
+	RegisterAlias("image", "dc")
+}
+
+// creator2MG identifies this software in 2MG headers
+const creator2MG = "MDRV"
+
+// lengthWriter passes writes through, checking that exactly the
+// expected number of bytes is written by the time it is closed
+type lengthWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *lengthWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, fmt.Errorf("image data exceeds expected length")
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *lengthWriter) Close() error {
+	if l.remaining != 0 {
+		return fmt.Errorf("image data %d bytes short of expected length", l.remaining)
+	}
+	return nil
+}
+
+// bufferWriter collects all of the disk data in memory, for formats
+// which can only be written once all of the data is known
+type bufferWriter struct {
+	bytes.Buffer
+	length int64
+	finish func(data []byte) error
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.length {
+		return 0, fmt.Errorf("image data exceeds expected length")
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *bufferWriter) Close() error {
+	if int64(b.Len()) != b.length {
+		return fmt.Errorf("image data %d bytes short of expected length", b.length-int64(b.Len()))
+	}
+	return b.finish(b.Bytes())
+}
+
+// readHeader reads up to size bytes from the start of r, returning
+// nil if they can't all be read.
+func readHeader(r io.ReaderAt, size int) []byte {
+	buf := make([]byte, size)
+	if read, _ := r.ReadAt(buf, 0); read != size {
+		return nil
+	}
+	return buf
+}
+
+// compressedFormat is a gzip, bzip2 or xz wrapper around another image
+type compressedFormat struct {
+	kind compressed.Kind
+}
+
+func (f *compressedFormat) Name() string        { return f.kind.String() }
+func (f *compressedFormat) Description() string { return f.kind.String() + " compressed" }
+
+func (f *compressedFormat) Detect(r io.ReaderAt) int {
+	header := make([]byte, compressed.SniffSize)
+	read, _ := r.ReadAt(header, 0)
+	if compressed.Sniff(header[:read]) == f.kind {
+		return DetectSure
+	}
+	return DetectNo
+}
+
+// Open returns the decompressed content, which is itself an image
+func (f *compressedFormat) Open(r io.ReaderAt) (Device, error) {
+	file, err := compressed.NewFile(r, f.Name())
+	if err != nil {
+		return Device{}, err
+	}
+	return Device{file, -1}, nil
+}
+
+// Create returns a compressor; whatever is written to it, which is
+// usually another image, is compressed into w
+func (f *compressedFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	return compressed.NewWriter(f.kind, w)
+}
+
+// mdtFormat is a whole Microdrive/Turbo card image
+type mdtFormat struct{}
+
+func (mdtFormat) Name() string        { return "mdt" }
+func (mdtFormat) Description() string { return "Microdrive/Turbo image" }
+
+func (mdtFormat) Detect(r io.ReaderAt) int {
+	var sector [mdturbo.SectorSize]byte
+	if read, _ := r.ReadAt(sector[:], 0); read != len(sector) {
+		return DetectNo
+	}
+	ptable, err := mdturbo.Deserialize(sector)
+	if err != nil || !ptable.Validate() {
+		return DetectNo
+	}
+	return DetectSure - 10 // Only two fields to go on
+}
+
+// Open returns the whole card; its size isn't needed to use it
+func (mdtFormat) Open(r io.ReaderAt) (Device, error) {
+	return Device{r, -1}, nil
+}
+
+// Create isn't supported: cards are built up with partition tables
+func (mdtFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// h2mgFormat is a 2MG image
+type h2mgFormat struct{}
+
+func (h2mgFormat) Name() string        { return "2mg" }
+func (h2mgFormat) Description() string { return "2MG image" }
+
+func (h2mgFormat) Detect(r io.ReaderAt) int {
+	buf := readHeader(r, h2mg.HeaderSize)
+	if buf == nil {
+		return DetectNo
+	}
+	header, err := h2mg.Parse2MG(buf)
+	if err != nil || header.Magic != "2IMG" {
+		return DetectNo
+	}
+	if header.Validate() != nil {
+		return DetectLikely
+	}
+	return DetectSure
+}
+
+func (h2mgFormat) Open(r io.ReaderAt) (Device, error) {
+	buf := readHeader(r, h2mg.HeaderSize)
+	if buf == nil {
+		return Device{}, fmt.Errorf("2MG header too short")
+	}
+	header, err := h2mg.Parse2MG(buf)
+	if err != nil {
+		return Device{}, fmt.Errorf("could not parse header: %v", err)
+	}
+	if err = header.Validate(); err != nil {
+		return Device{}, fmt.Errorf("could not validate: %v", err)
+	}
+	length := int64(header.Length)
+	return Device{io.NewSectionReader(r, int64(header.Offset), length), length}, nil
+}
+
+func (h2mgFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	if length%BlockSize != 0 {
+		return nil, fmt.Errorf("2MG images must be a whole number of blocks")
+	}
+	header := h2mg.New2MG(creator2MG, uint32(length/BlockSize))
+	if _, err := w.Write(header.Serialize()); err != nil {
+		return nil, err
+	}
+	return &lengthWriter{w, length}, nil
+}
+
+// wozFormat is a WOZ 1.0 or 2.0 image
+type wozFormat struct{}
+
+func (wozFormat) Name() string        { return "woz" }
+func (wozFormat) Description() string { return "WOZ image" }
+
+func (wozFormat) Detect(r io.ReaderAt) int {
+	if header := readHeader(r, woz.HeaderSize); header != nil && woz.IsWOZ(header) {
+		return DetectSure
+	}
+	return DetectNo
+}
+
+// Open decodes the whole disk into blocks up front, since WOZ images
+// hold raw track bitstreams
+func (wozFormat) Open(r io.ReaderAt) (Device, error) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return Device{}, err
+	}
+	img, err := woz.Parse(data)
+	if err != nil {
+		return Device{}, err
+	}
+	blocks, err := img.Decode()
+	if err != nil {
+		return Device{}, err
+	}
+	return Device{bytes.NewReader(blocks), int64(len(blocks))}, nil
+}
+
+// Create isn't supported: encoding tracks is a job for another day
+func (wozFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// DiskCopy 4.2 header layout
+const (
+	dcHeaderSize    = 0x54
+	dcNameMax       = 63
+	dcDataSizeOff   = 0x40
+	dcTagSizeOff    = 0x44
+	dcDataCheckOff  = 0x48
+	dcDiskFormatOff = 0x50
+	dcFormatByteOff = 0x51
+	dcMagicOff      = 0x52
+	dcMagic         = 0x0100
+)
+
+// dcName is the volume name written into new DiskCopy images
+const dcName = "-not a Macintosh disk-"
+
+// dcChecksum computes the DiskCopy 4.2 data checksum
+func dcChecksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		sum = sum>>1 | sum<<31
+	}
+	return sum
+}
+
+// diskCopyFormat is a DiskCopy 4.2 image, as used for 3.5" disks
+type diskCopyFormat struct{}
+
+func (diskCopyFormat) Name() string        { return "dc" }
+func (diskCopyFormat) Description() string { return "DiskCopy 4.2 image" }
+
+func (diskCopyFormat) Detect(r io.ReaderAt) int {
+	header := readHeader(r, dcHeaderSize)
+	if header == nil || header[0] > dcNameMax ||
+		binary.BigEndian.Uint16(header[dcMagicOff:]) != dcMagic {
+		return DetectNo
+	}
+	dataSize := int64(binary.BigEndian.Uint32(header[dcDataSizeOff:]))
+	tagSize := int64(binary.BigEndian.Uint32(header[dcTagSizeOff:]))
+	if dataSize == 0 || dataSize%BlockSize != 0 {
+		return DetectNo
+	}
+	if size := DetectSize(r); size != -1 && size != dcHeaderSize+dataSize+tagSize {
+		return DetectMaybe
+	}
+	return DetectSure - 10 // The magic number is only two bytes
+}
+
+func (diskCopyFormat) Open(r io.ReaderAt) (Device, error) {
+	header := readHeader(r, dcHeaderSize)
+	if header == nil {
+		return Device{}, fmt.Errorf("DiskCopy header too short")
+	}
+	dataSize := int64(binary.BigEndian.Uint32(header[dcDataSizeOff:]))
+	if dataSize%BlockSize != 0 {
+		return Device{}, fmt.Errorf("data size %d is not a whole number of blocks", dataSize)
+	}
+	return Device{io.NewSectionReader(r, dcHeaderSize, dataSize), dataSize}, nil
+}
+
+// Create writes a 400K or 800K GCR image; the header checksum means
+// the data must be collected before anything is written
+func (diskCopyFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	// The format byte is 0x12 for a 400K disk, and 0x24 for an Apple II
+	// 800K disk (0x22 is a Macintosh one)
+	var diskFormat, formatByte byte
+	switch length {
+	case 400 * 1024:
+		diskFormat, formatByte = 0, 0x12
+	case 800 * 1024:
+		diskFormat, formatByte = 1, 0x24
+	default:
+		return nil, fmt.Errorf("DiskCopy images must be 400K or 800K")
+	}
+	finish := func(data []byte) error {
+		header := make([]byte, dcHeaderSize)
+		header[0] = byte(len(dcName))
+		copy(header[1:], dcName)
+		binary.BigEndian.PutUint32(header[dcDataSizeOff:], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[dcDataCheckOff:], dcChecksum(data))
+		header[dcDiskFormatOff] = diskFormat
+		header[dcFormatByteOff] = formatByte
+		binary.BigEndian.PutUint16(header[dcMagicOff:], dcMagic)
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	}
+	return &bufferWriter{length: length, finish: finish}, nil
+}
+
+// Standard 5.25" disk geometry
+const (
+	sectorSize525  = 256
+	sectorsPerTrk  = 16
+	trackSize525   = sectorSize525 * sectorsPerTrk
+	diskSize525    = 35 * trackSize525
+	vtocTrack      = 17
+	dos33CatSector = 15
+)
+
+// Sector interleaves, mapping logical sectors to physical sectors
+var (
+	prodosSkew = [sectorsPerTrk]int{0, 2, 4, 6, 8, 10, 12, 14, 1, 3, 5, 7, 9, 11, 13, 15}
+	dosSkew    = [sectorsPerTrk]int{0, 13, 11, 9, 7, 5, 3, 1, 14, 12, 10, 8, 6, 4, 2, 15}
+)
+
+// prodosToDOS maps a ProDOS logical sector to the DOS logical sector
+// stored at the same physical sector
+var prodosToDOS [sectorsPerTrk]int
+
+func init() {
+	for prodos, physical := range prodosSkew {
+		for dos := range dosSkew {
+			if dosSkew[dos] == physical {
+				prodosToDOS[prodos] = dos
+			}
+		}
+	}
+}
+
+// dosOrderReader presents a DOS-ordered 5.25" image in ProDOS order
+type dosOrderReader struct {
+	r io.ReaderAt
+}
+
+// ReadAt reads ProDOS-ordered data, one sector at a time
+func (d dosOrderReader) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= diskSize525 {
+			return n, io.EOF
+		}
+		track := pos / trackSize525
+		sector := (pos % trackSize525) / sectorSize525
+		within := pos % sectorSize525
+		chunk := sectorSize525 - within
+		if rest := int64(len(p) - n); rest < chunk {
+			chunk = rest
+		}
+		source := track*trackSize525 + int64(prodosToDOS[sector])*sectorSize525 + within
+		read, err := d.r.ReadAt(p[n:n+int(chunk)], source)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// dosOrderFormat is a 140K 5.25" image in DOS 3.3 sector order
+type dosOrderFormat struct{}
+
+func (dosOrderFormat) Name() string        { return "do" }
+func (dosOrderFormat) Description() string { return "DOS-order 5.25\" image" }
+
+func (dosOrderFormat) Detect(r io.ReaderAt) int {
+	if DetectSize(r) != diskSize525 {
+		return DetectNo
+	}
+	// A ProDOS volume stored in DOS order
+	if looksLikeProDOS(dosOrderReader{r}) {
+		return DetectSure - 15
+	}
+	// A DOS 3.3 volume: the VTOC points at the catalog, whose
+	// sectors link downwards in DOS order
+	vtoc := make([]byte, sectorSize525)
+	if _, err := r.ReadAt(vtoc, vtocTrack*trackSize525); err != nil {
+		return DetectNo
+	}
+	if vtoc[0x01] != vtocTrack || vtoc[0x02] != dos33CatSector || vtoc[0x35] != sectorsPerTrk {
+		return DetectNo
+	}
+	catalog := make([]byte, sectorSize525)
+	offset := int64(vtocTrack*trackSize525 + (dos33CatSector-1)*sectorSize525)
+	if _, err := r.ReadAt(catalog, offset); err != nil {
+		return DetectNo
+	}
+	if catalog[0x01] == vtocTrack && catalog[0x02] == dos33CatSector-2 {
+		return DetectSure - 20
+	}
+	return DetectMaybe
+}
+
+// Open checks the size of the image, if it can be found; images read
+// from a stream are taken to be the right size.
+func (dosOrderFormat) Open(r io.ReaderAt) (Device, error) {
+	if size, err := Size(r); err == nil && size != diskSize525 {
+		return Device{}, fmt.Errorf("DOS-order images must be %d bytes", diskSize525)
+	}
+	return Device{dosOrderReader{r}, diskSize525}, nil
+}
+
+// Create collects a whole disk and writes it out in DOS order
+func (dosOrderFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	if length != diskSize525 {
+		return nil, fmt.Errorf("DOS-order images must be %d bytes", diskSize525)
+	}
+	finish := func(data []byte) error {
+		out := make([]byte, len(data))
+		for track := 0; track < diskSize525/trackSize525; track++ {
+			for prodos, dos := range prodosToDOS {
+				from := track*trackSize525 + prodos*sectorSize525
+				to := track*trackSize525 + dos*sectorSize525
+				copy(out[to:to+sectorSize525], data[from:from+sectorSize525])
+			}
+		}
+		_, err := w.Write(out)
+		return err
+	}
+	return &bufferWriter{length: length, finish: finish}, nil
+}
+
+// prodosOrderFormat is a raw ProDOS-ordered image, such as HDV or PO
+type prodosOrderFormat struct{}
+
+func (prodosOrderFormat) Name() string        { return "po" }
+func (prodosOrderFormat) Description() string { return "ProDOS-order image" }
+
+func (prodosOrderFormat) Detect(r io.ReaderAt) int {
+	if looksLikeProDOS(r) {
+		return DetectSure - 20
+	}
+	if size := DetectSize(r); size > 0 && size%BlockSize == 0 {
+		return DetectMaybe
+	}
+	return DetectNo
+}
+
+// Open returns the whole image; its length is only given if it can be
+// found without reading all of it
+func (prodosOrderFormat) Open(r io.ReaderAt) (Device, error) {
+	return Device{r, DetectSize(r)}, nil
+}
+
+func (prodosOrderFormat) Create(w io.Writer, length int64) (io.WriteCloser, error) {
+	return &lengthWriter{w, length}, nil
+}
+
+// looksLikeProDOS returns true if a ProDOS-ordered image has a ProDOS
+// volume directory header in block 2.
+func looksLikeProDOS(r io.ReaderAt) bool {
+	const volDirBlock = 2
+	block := make([]byte, BlockSize)
+	if read, _ := r.ReadAt(block, volDirBlock*BlockSize); read != BlockSize {
+		return false
+	}
+	return block[0] == 0 && block[1] == 0 && // No previous block
+		block[0x04]>>4 == 0xf && // Volume directory header
+		block[0x23] == 0x27 && block[0x24] == 0x0d // Entry length & count
+}
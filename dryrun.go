@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/journal"
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// plannedWrite is a range of a card that a command would write
+type plannedWrite struct {
+	journal.Range
+	What string
+}
+
+// dryRun prints what a command would do to a card, for --dry-run: the
+// changes to the partition table, and the ranges of bytes written
+func dryRun(targetFile string, before, after mdturbo.MDTurbo, writes []plannedWrite) {
+	fmt.Printf("Dry run; %s has not been changed\n", targetFile)
+	if diff, equal := tableDiff(before, after); equal {
+		fmt.Println("Partition table: unchanged")
+	} else {
+		fmt.Printf("Partition table changes:\n%s\n", diff)
+	}
+	for _, w := range writes {
+		fmt.Printf("Would write bytes %d-%d (%d bytes): %s\n",
+			w.Offset, w.Offset+w.Length-1, w.Length, w.What)
+	}
+	// Undo removes from the journal rather than adding to it
+	if !cli.NoJournal && cli.Undo == nil && len(writes) > 0 {
+		fmt.Printf("Would save undo information in %s\n", journalName(targetFile))
+	}
+}
+
+// tableWrite is the write of a card's partition table
+var tableWrite = plannedWrite{tableRange, "partition table"}
+
+// importWrites returns the writes of an image of length bytes into a
+// partition; a length of -1 means it isn't known
+func importWrites(partition mdturbo.Partition, partNum uint8, length int64, opts importOptions) []plannedWrite {
+	whole := partitionRange(partition)
+	what := fmt.Sprintf("image data for partition %d", partNum)
+	if opts.Expand {
+		what += ", then its ProDOS volume expanded"
+	}
+	if length < 0 {
+		return []plannedWrite{{whole, what + "; the image length is unknown, so up to the whole partition"}}
+	}
+	writes := []plannedWrite{{journal.Range{Offset: whole.Offset, Length: length}, what}}
+	if !opts.KeepTail && length < whole.Length {
+		writes = append(writes, plannedWrite{
+			journal.Range{Offset: whole.Offset + length, Length: whole.Length - length},
+			fmt.Sprintf("zeroes to the end of partition %d", partNum),
+		})
+	}
+	return writes
+}
+
+// tableCard stands in for a card in a dry run. It keeps whatever is
+// written to the partition table, and discards everything else.
+type tableCard struct {
+	table [mdturbo.PartitionBlkLen]byte
+}
+
+// WriteAt keeps any part of a write that lands in the partition table
+func (c *tableCard) WriteAt(p []byte, off int64) (int, error) {
+	if off < int64(len(c.table)) {
+		copy(c.table[off:], p)
+	}
+	return len(p), nil
+}
@@ -1,36 +1,80 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 )
 
 import (
-	// "github.com/disappearinjon/microdrive/h2mg"
+	"github.com/disappearinjon/microdrive/compressed"
+	"github.com/disappearinjon/microdrive/diskimage"
 	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+	"github.com/disappearinjon/microdrive/transfer"
 )
 
 // ExportCmd contains the CLI args and flags for the export command
 type ExportCmd struct {
 	Source    string `arg:"positional,required" help:"Microdrive/Turbo image file"`
-	Target    string `arg:"positional,required" help:"Hard Drive Image File"`
-	Type      string `arg:"-s"  help:"Target file type: auto, 2mg, hdv, po" default:"auto"`
-	Partition uint8  `arg:"required" help:"Partition number"`
+	Target    string `arg:"positional" help:"Hard Drive Image File, or - for stdout; with --all, the output directory"`
+	Type      string `arg:"-s"  help:"Target file type: auto, 2mg, dc, do, hdv, po; required for stdout" default:"auto"`
+	Partition *uint8 `help:"Partition number; required unless --all is given"`
+	All       bool   `help:"Export every partition, named by --template" default:"false"`
+	Template  string `help:"Filename template for --all; fields are {index}, {volname}, {blocks} and {source}" default:"{index:02}-{volname}.po"`
+	Manifest  string `help:"Manifest file for --all (default: manifest.json in the output directory)"`
 	Force     bool   `help:"Force overwrite of an existing disk" default:"false"`
+	Compress  string `arg:"-z" help:"Compress output: auto, none, gzip, xz" default:"auto"`
+	Trim      bool   `help:"Export only the blocks the ProDOS volume occupies" default:"false"`
+	Shrink    bool   `help:"Shrink the exported ProDOS volume to its highest used block; implies --trim" default:"false"`
+	Verify    bool   `help:"Read each image back after writing, to check it; past the system's cache on 64-bit Linux only" default:"false"`
 }
 
-func exportPartition() error {
-	return exportImage(cli.Export.Source, cli.Export.Target,
-		cli.Export.Type, cli.Export.Partition, cli.Export.Force)
+// exportOptions controls how a partition is written out as an image
+type exportOptions struct {
+	Type     string // Target image type, or "auto"
+	Compress string // Compression type, or "auto"
+	Force    bool   // Overwrite an existing target
+	Trim     bool   // Export only the volume, not the whole partition
+	Shrink   bool   // Shrink the volume before exporting it
+	Verify   bool   // Read back and check what was written
 }
 
-func exportImage(sourceFile, targetFile, targetType string, partNum uint8, force bool) error {
-	source, partMap, err := getSource(sourceFile, force)
-	defer source.Close()
+func exportPartition(ctx context.Context) error {
+	opts := exportOptions{
+		Type:     cli.Export.Type,
+		Compress: cli.Export.Compress,
+		Force:    cli.Export.Force,
+		Trim:     cli.Export.Trim,
+		Shrink:   cli.Export.Shrink,
+		Verify:   cli.Export.Verify,
+	}
+	if cli.Export.All {
+		if cli.Export.Partition != nil {
+			return fmt.Errorf("--partition and --all can't be used together")
+		}
+		if cli.Export.Target == stdioName {
+			return fmt.Errorf("--all writes to a directory, not stdout")
+		}
+		return exportAll(ctx, cli.Export.Source, cli.Export.Target,
+			cli.Export.Template, cli.Export.Manifest, opts)
+	}
+	if cli.Export.Partition == nil {
+		return fmt.Errorf("--partition is required unless --all is given")
+	}
+	if cli.Export.Target == "" {
+		return fmt.Errorf("target is required unless --all is given")
+	}
+	return exportImage(ctx, cli.Export.Source, cli.Export.Target, *cli.Export.Partition, opts)
+}
+
+func exportImage(ctx context.Context, sourceFile, targetFile string, partNum uint8, opts exportOptions) error {
+	source, partMap, err := getSource(sourceFile, opts.Force)
 	if err != nil {
 		return err
 	}
+	defer source.Close()
 
 	// Fail early if partition is unavailable
 	if partNum >= partMap.PartCount() {
@@ -38,57 +82,241 @@ func exportImage(sourceFile, targetFile, targetType string, partNum uint8, force
 			partNum, partMap.PartCount()-1)
 	}
 
+	_, err = writePartitionImage(ctx, source, partMap, partNum, targetFile, opts)
+	return err
+}
+
+// exportedImage describes an image written by export
+type exportedImage struct {
+	Partition   uint8  `json:"partition"`
+	File        string `json:"file"`
+	Format      string `json:"format"`
+	Compression string `json:"compression"`
+	Volume      string `json:"volume,omitempty"` // ProDOS volume name
+	Start       uint32 `json:"start"`            // First sector of the partition
+	Sectors     uint32 `json:"sectors"`          // Length of the partition
+	Bytes       int64  `json:"bytes"`            // Disk data exported
+	SHA256      string `json:"sha256"`           // Hash of the disk data
+}
+
+// writePartitionImage writes one partition of an open card image out
+// as an image file, or to stdout if targetFile is -
+func writePartitionImage(ctx context.Context, source io.ReaderAt, partMap mdturbo.MDTurbo, partNum uint8, targetFile string, opts exportOptions) (exported exportedImage, err error) {
+	stream := targetFile == stdioName
+	if stream && opts.Type == "auto" {
+		return exported, fmt.Errorf("--type is required when writing to stdout")
+	}
+	if stream && opts.Verify {
+		return exported, fmt.Errorf("can't verify an image written to stdout")
+	}
+
 	// Fail early if can't write in the requested format
-	if targetType == "auto" {
-		targetType = imageAutoDetect(targetFile)
+	var format diskimage.ImageFormat
+	if opts.Type == "auto" {
+		format = diskimage.ForFilename(targetFile)
+		if format == nil {
+			return exported, fmt.Errorf("could not tell the disk image type of %s from its name; use --type", targetFile)
+		}
+	} else {
+		format = diskimage.Lookup(opts.Type)
+		if format == nil {
+			return exported, fmt.Errorf("no support for disk image type %s", opts.Type)
+		}
 	}
-	if targetType != "hdv" && targetType != "po" {
-		return fmt.Errorf("no support for disk image type %s", targetType)
+	var kind compressed.Kind
+	if opts.Compress == "auto" {
+		kind = compressed.KindFromName(targetFile)
+	} else {
+		kind, err = compressed.ParseKind(opts.Compress)
+		if err != nil {
+			return
+		}
+	}
+
+	// Get partition data
+	partition, err := partMap.GetPartition(partNum)
+	if err != nil {
+		return exported, fmt.Errorf("failed to get partition: %v", err)
+	}
+	length := int64(partition.Length()) * mdturbo.SectorSize
+	var input io.ReaderAt = io.NewSectionReader(source, int64(partition.Start)*mdturbo.SectorSize, length)
+	if opts.Trim || opts.Shrink {
+		input, length, err = trimVolume(input, length, opts.Shrink)
+		if err != nil {
+			return exported, fmt.Errorf("could not trim partition %d: %v", partNum, err)
+		}
+	}
+
+	target, err := createTarget(targetFile, opts.Force)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	discard := func() {
+		target.Close()
+		if !stream {
+			os.Remove(targetFile)
+		}
+	}
+	output, err := compressed.NewWriter(kind, target)
+	if err != nil {
+		discard()
+		return exported, fmt.Errorf("could not compress %s: %v", targetFile, err)
+	}
+	image, err := format.Create(output, length)
+	if err != nil {
+		discard()
+		return exported, fmt.Errorf("could not create %s as %s: %v", targetFile, format.Description(), err)
+	}
+
+	// Copy bytes from the beginning of the partition
+	sums := newChecksummer()
+	data := io.TeeReader(io.NewSectionReader(input, 0, length), sums)
+	report := newProgress("Exporting", data, length)
+	_, err = transfer.Export(ctx, image, report, length)
+	report.Finish()
+	if cancelled := transfer.IsCancelled(err); cancelled != nil {
+		discard()
+		if stream {
+			return exported, fmt.Errorf("export of partition %d was %v", partNum, err)
+		}
+		return exported, fmt.Errorf("export of partition %d was %v; removed %s", partNum, err, targetFile)
+	}
+	if err != nil {
+		discard()
+		return exported, fmt.Errorf("export copy returned error: %v", err)
+	}
+	if err = image.Close(); err != nil {
+		return exported, fmt.Errorf("could not finish writing %s: %v", targetFile, err)
+	}
+	if err = output.Close(); err != nil {
+		return exported, fmt.Errorf("could not finish compressing %s: %v", targetFile, err)
+	}
+	if err = target.Close(); err != nil {
+		return exported, fmt.Errorf("could not close %s: %v", targetFile, err)
+	}
+
+	if opts.Verify {
+		if err = verifyImage(targetFile, format, length, sums); err != nil {
+			return exported, fmt.Errorf("verify of %s failed: %v", targetFile, err)
+		}
+		fmt.Fprintf(os.Stderr, "Verified %d bytes in %s\n", length, targetFile)
+	}
+
+	// And done
+	exported = exportedImage{
+		Partition:   partNum,
+		File:        targetFile,
+		Format:      format.Name(),
+		Compression: kind.String(),
+		Start:       partition.Start,
+		Sectors:     partition.Length(),
+		Bytes:       length,
+		SHA256:      sums.SHA256(),
+	}
+	if vol, err := prodos.ReadVolume(input); err == nil {
+		exported.Volume = vol.Name
+	}
+	return exported, nil
+}
+
+// createTarget creates an image file, failing if it exists unless force
+// is set. A targetFile of - is stdout.
+func createTarget(targetFile string, force bool) (io.WriteCloser, error) {
+	if targetFile == stdioName {
+		return os.Stdout, nil
 	}
 
 	// Check if target file already exists - if so, and not force,
 	// then fail
-	_, err = os.Stat(targetFile)
+	_, err := os.Stat(targetFile)
 	if (os.IsExist(err) || err == nil) && !force {
-		return fmt.Errorf("target %s exists - will not overwrite", targetFile)
+		return nil, fmt.Errorf("target %s exists - will not overwrite", targetFile)
 	}
 
 	// OK, create & truncate it
 	target, err := os.Create(targetFile)
 	if err != nil {
-		return fmt.Errorf("could not create target %s: %v", targetFile, err)
+		return nil, fmt.Errorf("could not create target %s: %v", targetFile, err)
 	}
-	defer target.Close()
+	return target, nil
+}
 
-	// Get partition data
-	partition, err := partMap.GetPartition(partNum)
+// verifyImage reopens an exported image, and checks its disk data
+// against the checksums taken while it was written
+func verifyImage(filename string, format diskimage.ImageFormat, length int64, sums *checksummer) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("failed to get partition: %v", err)
+		return err
 	}
+	defer file.Close()
+	if err = flushForVerify(file, 0, 0); err != nil {
+		return err
+	}
+	img, err := diskimage.Open(file, filename, format.Name())
+	if err != nil {
+		return err
+	}
+	if img.Length != -1 && img.Length != length {
+		return fmt.Errorf("image holds %d bytes, expected %d", img.Length, length)
+	}
+	return sums.verify(img, length)
+}
 
-	// Seek to the beginning of the partition
-	_, err = source.Seek(int64(partition.Start)*mdturbo.SectorSize, os.SEEK_SET)
-
-	// Copy bytes
-	length := int64(partition.Length()) * mdturbo.SectorSize
-	bytesWritten, err := io.CopyN(target, source, length)
+// trimVolume finds the size of the ProDOS volume on a partition, and
+// returns the partition data cut down to that size. With shrink, the
+// volume is first shrunk to its highest used block; the changes are
+// made to an in-memory copy of the affected blocks, never the source.
+func trimVolume(partition io.ReaderAt, length int64, shrink bool) (io.ReaderAt, int64, error) {
+	vol, err := prodos.ReadVolume(partition)
 	if err != nil {
-		return fmt.Errorf("export copy returned error: %v", err)
+		return nil, -1, err
 	}
-	if bytesWritten != length {
-		return fmt.Errorf("export expected %d bytes; copied %d",
-			length, bytesWritten)
+	if int64(vol.TotalBlocks)*prodos.BlockSize > length {
+		return nil, -1, fmt.Errorf("volume /%s (%d blocks) is larger than its partition",
+			vol.Name, vol.TotalBlocks)
 	}
+	original := vol.TotalBlocks
 
-	// And done
-	return nil
+	if shrink {
+		device := newOverlay(partition, length)
+		// Shrinking can release bitmap blocks, which may allow the
+		// volume to shrink further
+		for {
+			bitmap, err := prodos.ReadBitmap(device, vol)
+			if err != nil {
+				return nil, -1, err
+			}
+			blocks := bitmap.HighestUsed(int(vol.TotalBlocks)) + 1
+			if blocks >= int(vol.TotalBlocks) {
+				break
+			}
+			if vol, err = prodos.Resize(device, blocks); err != nil {
+				return nil, -1, err
+			}
+		}
+		partition = device
+	}
+
+	if vol.TotalBlocks != original {
+		fmt.Fprintf(os.Stderr, "Shrank volume /%s from %d to %d blocks\n",
+			vol.Name, original, vol.TotalBlocks)
+	} else {
+		fmt.Fprintf(os.Stderr, "Volume /%s has %d blocks\n", vol.Name, vol.TotalBlocks)
+	}
+	return partition, int64(vol.TotalBlocks) * prodos.BlockSize, nil
 }
 
-func getSource(sourceFile string, force bool) (source *os.File, partMap mdturbo.MDTurbo, err error) {
+// getSource opens a Microdrive/Turbo image for reading, decompressing
+// it on the fly if required, and returns its partition table.
+func getSource(sourceFile string, force bool) (source *cardImage, partMap mdturbo.MDTurbo, err error) {
 	// Get the partition table
 	partMap, err = GetPartitionTable(sourceFile)
+	if err != nil {
+		return
+	}
 	// Open the source file passed in for reading
-	source, err = os.Open(sourceFile)
+	source, err = openCardImage(sourceFile)
 	if err != nil {
 		err = fmt.Errorf("could not open %s: %v", sourceFile, err)
 		return
@@ -96,6 +324,7 @@ func getSource(sourceFile string, force bool) (source *os.File, partMap mdturbo.
 
 	// Validate partition table format
 	if !partMap.Validate() && !force {
+		source.Close()
 		err = fmt.Errorf("partition map on %s appears invalid", sourceFile)
 		return
 	}
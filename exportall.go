@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/compressed"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+)
+
+// untitledVolume names partitions with no ProDOS volume in templates
+const untitledVolume = "untitled"
+
+// exportManifest describes the images written by export --all
+type exportManifest struct {
+	Source  string          `json:"source"`
+	Created time.Time       `json:"created"`
+	Images  []exportedImage `json:"images"`
+}
+
+// templateField matches a {name} or {name:format} template field
+var templateField = regexp.MustCompile(`\{([a-z]+)(?::([^}]*))?\}`)
+
+// templateWidth matches the format of a padded number, such as 02
+var templateWidth = regexp.MustCompile(`^0?[0-9]+$`)
+
+// expandTemplate fills in the fields of a filename template. Number
+// fields may be given a width, zero-padded if it starts with 0, as in
+// {index:02}.
+func expandTemplate(template string, fields map[string]interface{}) (name string, err error) {
+	name = templateField.ReplaceAllStringFunc(template, func(field string) string {
+		parts := templateField.FindStringSubmatch(field)
+		value, ok := fields[parts[1]]
+		if !ok {
+			err = fmt.Errorf("unknown template field {%s}", parts[1])
+			return field
+		}
+		if parts[2] == "" {
+			return fmt.Sprint(value)
+		}
+		if _, isNumber := value.(int); !isNumber || !templateWidth.MatchString(parts[2]) {
+			err = fmt.Errorf("bad format %q for template field {%s}", parts[2], parts[1])
+			return field
+		}
+		return fmt.Sprintf("%"+parts[2]+"d", value)
+	})
+	return
+}
+
+// exportAll exports every partition of a card into a directory, naming
+// each image from a template, and writes a manifest describing them.
+func exportAll(ctx context.Context, sourceFile, targetDir, template, manifestFile string, opts exportOptions) error {
+	source, partMap, err := getSource(sourceFile, opts.Force)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if targetDir == "" {
+		targetDir = "."
+	}
+	if manifestFile == "" {
+		manifestFile = filepath.Join(targetDir, "manifest.json")
+	}
+	sourceName, _ := compressed.TrimSuffix(filepath.Base(sourceFile))
+	sourceName = strings.TrimSuffix(sourceName, filepath.Ext(sourceName))
+
+	// Name every image before writing any, so a bad template or a
+	// name clash doesn't leave a partial backup behind
+	names := make([]string, partMap.PartCount())
+	hasVolume := make([]bool, partMap.PartCount())
+	used := make(map[string]uint8)
+	for partNum := uint8(0); partNum < partMap.PartCount(); partNum++ {
+		partition, err := partMap.GetPartition(partNum)
+		if err != nil {
+			return fmt.Errorf("failed to get partition %d: %v", partNum, err)
+		}
+		volname := untitledVolume
+		vol, err := prodos.ReadVolume(io.NewSectionReader(source,
+			int64(partition.Start)*mdturbo.SectorSize, int64(partition.Length())*mdturbo.SectorSize))
+		if err == nil {
+			volname = vol.Name
+			hasVolume[partNum] = true
+		}
+		names[partNum], err = expandTemplate(template, map[string]interface{}{
+			"index":   int(partNum),
+			"volname": volname,
+			"blocks":  int(partition.Length()),
+			"source":  sourceName,
+		})
+		if err != nil {
+			return err
+		}
+		if other, ok := used[names[partNum]]; ok {
+			return fmt.Errorf("partitions %d and %d would both be exported as %s",
+				other, partNum, names[partNum])
+		}
+		used[names[partNum]] = partNum
+	}
+
+	if err = os.MkdirAll(targetDir, 0777); err != nil {
+		return fmt.Errorf("could not create %s: %v", targetDir, err)
+	}
+
+	manifest := exportManifest{Source: sourceFile, Created: time.Now().UTC()}
+	for partNum := uint8(0); partNum < partMap.PartCount(); partNum++ {
+		partOpts := opts
+		if !hasVolume[partNum] && (opts.Trim || opts.Shrink) {
+			fmt.Fprintf(os.Stderr, "WARNING: partition %d has no ProDOS volume; exporting it whole\n", partNum)
+			partOpts.Trim, partOpts.Shrink = false, false
+		}
+		var exported exportedImage
+		exported, err = writePartitionImage(ctx, source, partMap, partNum,
+			filepath.Join(targetDir, names[partNum]), partOpts)
+		if err != nil {
+			err = fmt.Errorf("could not export partition %d: %v", partNum, err)
+			break
+		}
+		exported.File = names[partNum]
+		manifest.Images = append(manifest.Images, exported)
+		fmt.Fprintf(os.Stderr, "Exported partition %d as %s\n", partNum, names[partNum])
+	}
+
+	// Describe whatever was exported, even if not everything was
+	marshaled, jsonErr := json.MarshalIndent(manifest, "", "\t")
+	if jsonErr == nil {
+		jsonErr = ioutil.WriteFile(manifestFile, append(marshaled, '\n'), 0666)
+	}
+	if jsonErr != nil && err == nil {
+		err = fmt.Errorf("could not write manifest %s: %v", manifestFile, jsonErr)
+	}
+	return err
+}
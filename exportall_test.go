@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]interface{}{
+		"index":   3,
+		"volname": "GAMES",
+		"blocks":  65535,
+		"source":  "mycard",
+	}
+	for _, tc := range []struct {
+		template string
+		expected string
+		err      string
+	}{
+		{"{source}-{index}-{volname}.po", "mycard-3-GAMES.po", ""},
+		{"{index:02}.po", "03.po", ""},
+		{"{index:3}.po", "  3.po", ""},
+		{"{blocks:08}", "00065535", ""},
+		{"plain.po", "plain.po", ""},
+		{"{bogus}.po", "", "unknown template field {bogus}"},
+		{"{volname:02}.po", "", "bad format"},
+		{"{index:x}.po", "", "bad format"},
+		{"{index:-2}.po", "", "bad format"},
+	} {
+		name, err := expandTemplate(tc.template, fields)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: expanded to %q with error %v, expected %q", tc.template, name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.template, err)
+		} else if name != tc.expected {
+			t.Errorf("%q: expanded to %q, expected %q", tc.template, name, tc.expected)
+		}
+	}
+}
+
+func TestExportAllNameClash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exportall")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Neither partition holds a ProDOS volume, so both are untitled
+	table := mdturbo.MDTurbo{Magic: 52426}
+	table.AddPartition(16)
+	table.AddPartition(16)
+	card := newCardFile(t, dir, table, 288)
+
+	for _, tc := range []struct {
+		template string
+		err      string
+	}{
+		{"{volname}.po", "partitions 0 and 1 would both be exported as untitled.po"},
+		{"{index}-{bogus}.po", "unknown template field {bogus}"},
+	} {
+		targetDir := filepath.Join(dir, "backup")
+		err = exportAll(context.Background(), card, targetDir, tc.template, "", exportOptions{})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: returned %v, expected %q", tc.template, err, tc.err)
+		}
+		if _, err = os.Stat(targetDir); !os.IsNotExist(err) {
+			t.Errorf("%q: %s was created before the names were checked", tc.template, targetDir)
+		}
+	}
+}
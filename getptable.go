@@ -2,33 +2,70 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 )
 
 import (
+	"github.com/disappearinjon/microdrive/compressed"
+	"github.com/disappearinjon/microdrive/diskimage"
 	"github.com/disappearinjon/microdrive/mdturbo"
 )
 
+// cardImage is a Microdrive/Turbo image opened for reading
+type cardImage struct {
+	io.ReaderAt
+	Description string // Detected format
+
+	file cardFile
+}
+
+// Close closes the underlying file
+func (c *cardImage) Close() error {
+	return c.file.Close()
+}
+
+// openCardImage opens a Microdrive/Turbo image or device for reading,
+// removing any compression. If the image looks like some other format, a
+// warning is printed, but the image is opened regardless.
+func openCardImage(filename string) (*cardImage, error) {
+	file, err := openCardFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := diskimage.Open(file, filename, "mdt")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	format, confidence := diskimage.Detect(img.ReaderAt)
+	if confidence >= diskimage.DetectLikely && format != img.Format {
+		fmt.Fprintf(os.Stderr, "WARNING: %s looks like %s, not a Microdrive/Turbo image\n",
+			filename, format.Description())
+	}
+	return &cardImage{ReaderAt: img.ReaderAt, Description: img.Description, file: file}, nil
+}
+
 // GetPartitionTable returns an MDTurbo data structure and an error when
-// provided a filename.
+// provided a filename. Compressed images are read transparently.
 func GetPartitionTable(filename string) (ptable mdturbo.MDTurbo, err error) {
 
 	// Open the file passed in for reading
-	imagefile, err := os.Open(filename)
-	defer imagefile.Close()
+	imagefile, err := openCardImage(filename)
 	if err != nil {
 		return
 	}
+	defer imagefile.Close()
 
 	// Get first disk sector, where the partition table sits
 	var firstSector [mdturbo.SectorSize]byte
-	buf := make([]byte, mdturbo.SectorSize)
-	read, err := imagefile.Read(buf)
-	if err != nil {
+	read, err := imagefile.ReadAt(firstSector[:], 0)
+	if err != nil && err != io.EOF {
 		return
 	}
-	fmt.Fprintf(os.Stderr, "Read %v bytes\n", read)
-	copy(firstSector[:], buf)
+	err = nil
+	fmt.Fprintf(os.Stderr, "Read %v bytes from %s (%s)\n", read, filename, imagefile.Description)
 
 	// Parse the sector
 	ptable, err = mdturbo.Deserialize(firstSector)
@@ -41,3 +78,20 @@ func GetPartitionTable(filename string) (ptable mdturbo.MDTurbo, err error) {
 
 	return
 }
+
+// refuseCompressed returns an error if filename exists and is a
+// compressed image, since those can't be modified in place.
+func refuseCompressed(filename string) error {
+	imagefile, err := compressed.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer imagefile.Close()
+	if imagefile.Kind() != compressed.None {
+		return fmt.Errorf("%s is %v compressed; decompress it before modifying", filename, imagefile.Kind())
+	}
+	return nil
+}
@@ -28,6 +28,7 @@ const (
 // Header2MG is the struct containing parsed .2MG header data
 type Header2MG struct {
 	Magic       string // Magic Number
+	Creator     string // Creator of the image
 	HeaderSize  uint16 // Size of header, in bytes
 	Version     uint16 // Version number of 2MG format
 	ImageFormat uint32 // Image Format Choices
@@ -67,6 +68,7 @@ func Parse2MG(data []uint8) (Header2MG, error) {
 		return result, fmt.Errorf("2mg header too short: expected %d bytes, got %d", HeaderSize, len(data))
 	}
 	result.Magic = string(data[0x00 : 0x03+1]) // Magic Text
+	result.Creator = string(data[0x04 : 0x07+1])
 	result.HeaderSize = binary.LittleEndian.Uint16(data[0x08 : 0x09+1])
 	result.Version = binary.LittleEndian.Uint16(data[0x0a : 0x0b+1])
 	result.ImageFormat = binary.LittleEndian.Uint32(data[0x0c : 0x0f+1])
@@ -76,3 +78,34 @@ func Parse2MG(data []uint8) (Header2MG, error) {
 
 	return result, nil
 }
+
+// New2MG returns a header for a ProDOS-ordered image of the given
+// number of blocks, with the data immediately following the header.
+func New2MG(creator string, blocks uint32) Header2MG {
+	return Header2MG{
+		Magic:       "2IMG",
+		Creator:     creator,
+		HeaderSize:  HeaderSize,
+		Version:     1,
+		ImageFormat: FormatProDOS,
+		BlockCount:  blocks,
+		Offset:      HeaderSize,
+		Length:      blocks * BlockSize,
+	}
+}
+
+// Serialize returns the header as a byte slice suitable for writing to
+// the start of an image file. Fields not in Header2MG are left zeroed.
+func (h2 Header2MG) Serialize() []uint8 {
+	data := make([]uint8, HeaderSize)
+	copy(data[0x00:0x03+1], h2.Magic)
+	copy(data[0x04:0x07+1], h2.Creator)
+	binary.LittleEndian.PutUint16(data[0x08:0x09+1], h2.HeaderSize)
+	binary.LittleEndian.PutUint16(data[0x0a:0x0b+1], h2.Version)
+	binary.LittleEndian.PutUint32(data[0x0c:0x0f+1], h2.ImageFormat)
+	binary.LittleEndian.PutUint32(data[0x14:0x17+1], h2.BlockCount)
+	binary.LittleEndian.PutUint32(data[0x18:0x1b+1], h2.Offset)
+	binary.LittleEndian.PutUint32(data[0x1c:0x1f+1], h2.Length)
+
+	return data
+}
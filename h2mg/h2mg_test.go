@@ -0,0 +1,25 @@
+package h2mg
+
+import (
+	"testing"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	header := New2MG("MDRV", 280)
+	if err := header.Validate(); err != nil {
+		t.Fatalf("new header failed to validate: %v", err)
+	}
+	parsed, err := Parse2MG(header.Serialize())
+	if err != nil {
+		t.Fatalf("could not parse serialized header: %v", err)
+	}
+	if parsed != header {
+		t.Errorf("round trip mismatch: got %+v, wanted %+v", parsed, header)
+	}
+}
+
+func TestParseShort(t *testing.T) {
+	if _, err := Parse2MG(make([]uint8, HeaderSize-1)); err == nil {
+		t.Errorf("short header parsed without error")
+	}
+}
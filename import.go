@@ -1,52 +1,104 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 )
 
 import (
-	"github.com/disappearinjon/microdrive/h2mg"
+	"github.com/disappearinjon/microdrive/diskimage"
 	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+	"github.com/disappearinjon/microdrive/transfer"
 )
 
 // ImportCmd contains the CLI args and flags for the import command
 type ImportCmd struct {
-	Source    string `arg:"positional,required" help:"Hard Drive Image File"`
-	Target    string `arg:"positional,required" help:"Microdrive/Turbo image file"`
-	Type      string `arg:"-s"  help:"Source file type: auto, 2mg, hdv, po" default:"auto"`
-	Partition uint8  `arg:"required" help:"Partition number"`
+	Source    string `arg:"positional" help:"Hard Drive Image File, archive.zip:image, or - for stdin; omit with --manifest"`
+	Target    string `arg:"positional" help:"Microdrive/Turbo image file"`
+	Type      string `arg:"-s"  help:"Source file type: auto, 2mg, dc, do, hdv, po, woz; required for stdin" default:"auto"`
+	Partition string `help:"Partition number, or auto for the smallest empty partition that fits; required unless --manifest is given"`
+	Yes       bool   `arg:"-y" help:"Don't ask before importing into an automatically chosen partition" default:"false"`
+	Manifest  string `arg:"-m" help:"YAML or JSON manifest listing images and their partitions"`
 	Force     bool   `help:"Force write even in unsafe conditions" default:"false"`
+	Expand    bool   `help:"Grow the ProDOS volume to fill the partition" default:"false"`
+	KeepTail  bool   `arg:"--keep-tail" help:"Leave the partition past the end of the image untouched, instead of zeroing it" default:"false"`
+	Verify    bool   `help:"Read the partition back after writing, to check it; past the system's cache on 64-bit Linux only" default:"false"`
 }
 
-func importPartition() error {
-	return importImage(cli.Import.Source, cli.Import.Target,
-		cli.Import.Type, cli.Import.Partition, cli.Import.Force)
+// importOptions controls how an image is written into a partition
+type importOptions struct {
+	Type     string // Source image type, or "auto"
+	Force    bool   // Write even in unsafe conditions
+	Expand   bool   // Grow the ProDOS volume to fill the partition
+	KeepTail bool   // Don't zero the partition past the end of the image
+	Verify   bool   // Read back and check what was written
 }
 
-func importImage(sourceFile, targetFile, targetType string, partNum uint8, force bool) error {
-	var sourceLength int64 // Length of source file, minus headers
-
-	// Open the source file passed in for reading
-	source, err := os.Open(sourceFile)
-	defer source.Close()
+func importPartition(ctx context.Context) error {
+	opts := importOptions{
+		Type:     cli.Import.Type,
+		Force:    cli.Import.Force,
+		Expand:   cli.Import.Expand,
+		KeepTail: cli.Import.KeepTail,
+		Verify:   cli.Import.Verify,
+	}
+	if cli.Import.Manifest != "" {
+		// The only positional argument is the target
+		if cli.Import.Target != "" || cli.Import.Source == "" {
+			return fmt.Errorf("with --manifest, give only the target image")
+		}
+		if cli.Import.Partition != "" {
+			return fmt.Errorf("--partition and --manifest can't be used together")
+		}
+		return importManifest(ctx, cli.Import.Manifest, cli.Import.Source, opts)
+	}
+	if cli.Import.Source == "" || cli.Import.Target == "" {
+		return fmt.Errorf("source and target are required unless --manifest is given")
+	}
+	if cli.Import.Partition == "" {
+		return fmt.Errorf("--partition is required unless --manifest is given")
+	}
 
+	// Open the source once, as it may be a stream
+	source, err := openSourceImage(cli.Import.Source, opts.Type)
 	if err != nil {
 		return err
 	}
+	defer source.Close()
 
-	sourceLength, err = getSourceLength(source, targetType)
-	if err != nil {
-		return fmt.Errorf("could not get source length for %s: %v", sourceFile, err)
+	var partNum uint8
+	if strings.ToLower(cli.Import.Partition) == autoPartition {
+		partNum, err = choosePartition(source, cli.Import.Source, cli.Import.Target, cli.Import.Yes || cli.DryRun)
+		if err != nil {
+			return err
+		}
+	} else {
+		num, err := strconv.ParseUint(cli.Import.Partition, 10, 8)
+		if err != nil {
+			return fmt.Errorf("bad partition number %s", cli.Import.Partition)
+		}
+		partNum = uint8(num)
 	}
+	if err = importImage(ctx, source, cli.Import.Target, partNum, opts); err != nil || cli.DryRun {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %s to partition %d\n", cli.Import.Source, partNum)
+	return nil
+}
 
-	target, partMap, err := getTarget(targetFile, force)
-	defer target.Close()
+// importImage writes an open source image into a partition of a card
+func importImage(ctx context.Context, source sourceImage, targetFile string, partNum uint8, opts importOptions) error {
+	target, partMap, err := getTarget(targetFile, opts.Force)
 	if err != nil {
 		return fmt.Errorf("could not open target %s: %v", targetFile, err)
 	}
+	defer target.Close()
 
 	// Get partition data
 	if partNum >= partMap.PartCount() {
@@ -57,94 +109,186 @@ func importImage(sourceFile, targetFile, targetType string, partNum uint8, force
 		return fmt.Errorf("failed to get partition: %v", err)
 	}
 
-	// Fail if partition is smaller than the file to be read
-	if sourceLength > int64(partition.Length())*mdturbo.SectorSize {
+	// Fail if partition is smaller than the file to be read. Images
+	// of unknown length are checked as they're copied.
+	if source.Length > int64(partition.Length())*mdturbo.SectorSize {
 		return fmt.Errorf("source (%d) larger than target partition (%d)",
-			sourceLength, partition.Length()*mdturbo.SectorSize)
+			source.Length, partition.Length()*mdturbo.SectorSize)
 	}
 
-	// Seek to the beginning of the partition
-	_, err = target.Seek(int64(partition.Start)*mdturbo.SectorSize, os.SEEK_SET)
+	if cli.DryRun {
+		dryRun(targetFile, partMap, partMap, importWrites(partition, partNum, source.Length, opts))
+		return nil
+	}
+	if err = saveUndo(target, partitionRange(partition)); err != nil {
+		return err
+	}
+	if err = copyImage(ctx, target, partition, partNum, source, opts); err != nil {
+		return err
+	}
+	return target.Commit()
+}
 
-	// Copy bytes
-	bytesWritten, err := io.CopyN(target, source, sourceLength)
-	if err != nil {
+// copyImage copies a source image into a partition of an open card,
+// then zeroes the rest of the partition and expands the volume, as
+// the options ask. A source of known length must fit the partition;
+// one of unknown length, such as a stream, fails if it doesn't.
+func copyImage(ctx context.Context, target *targetCard, partition mdturbo.Partition, partNum uint8, source sourceImage, opts importOptions) error {
+	data, report, sums := importReader(source, opts.Verify)
+	written, err := transfer.Import(ctx, target, partition, data, source.Length, opts.KeepTail)
+	report.Finish()
+	switch {
+	case transfer.IsCancelled(err) != nil:
+		return fmt.Errorf("import into partition %d was %v; the partition holds an incomplete image",
+			partNum, err)
+	case err == transfer.ErrTooLarge:
+		return fmt.Errorf("source larger than target partition (%d)",
+			partition.Length()*mdturbo.SectorSize)
+	case err != nil:
 		return fmt.Errorf("import copy returned error: %v", err)
 	}
-	if bytesWritten != sourceLength {
-		return fmt.Errorf("import expected %d bytes; copied %d",
-			sourceLength, bytesWritten)
+	return finishImport(target, partition, partNum, written, sums, opts)
+}
+
+// importReader returns the data of a source image, counted for
+// progress reports, and checksummed if it's to be verified
+func importReader(source sourceImage, verify bool) (io.Reader, *progress, *checksummer) {
+	var data io.Reader = source
+	var sums *checksummer
+	if verify {
+		sums = newChecksummer()
+		data = io.TeeReader(source, sums)
+	}
+	report := newProgress("Importing", data, source.Length)
+	return report, report, sums
+}
+
+// finishImport checks an image of length bytes just copied into a
+// partition, and expands its volume, as the options ask
+func finishImport(target *targetCard, partition mdturbo.Partition, partNum uint8, length int64, sums *checksummer, opts importOptions) (err error) {
+	device := newPartitionDevice(target, partition)
+	if opts.Verify {
+		if err = flushForVerify(target.File, int64(partition.Start)*mdturbo.SectorSize, length); err != nil {
+			return err
+		}
+		if err = sums.verify(device, length); err != nil {
+			return fmt.Errorf("verify of partition %d failed: %v", partNum, err)
+		}
+		fmt.Fprintf(os.Stderr, "Verified %d bytes in partition %d\n", length, partNum)
+	}
+
+	if opts.Expand {
+		if err = expandVolume(device); err != nil {
+			return fmt.Errorf("could not expand volume: %v", err)
+		}
 	}
 
 	// And done
 	return nil
 }
 
-// getSourceLength gets the length of the source image, and sets the
-// offset at the end of the header, if any.
-func getSourceLength(source *os.File, targetType string) (length int64, err error) {
-	fi, err := source.Stat()
+// expandVolume grows the ProDOS volume on a partition to fill it, up to
+// the largest size ProDOS supports
+func expandVolume(device partitionDevice) error {
+	vol, err := prodos.ReadVolume(device)
 	if err != nil {
-		return -1, fmt.Errorf("could not stat source file")
+		return err
 	}
-	fileName := fi.Name()
-
-	if targetType == "auto" {
-		targetType = imageAutoDetect(fileName)
+	blocks := device.Size() / prodos.BlockSize
+	if blocks > prodos.MaxBlocks {
+		blocks = prodos.MaxBlocks
 	}
-	switch strings.ToLower(targetType) {
-	case "2mg":
-		buf := make([]uint8, h2mg.HeaderSize)
-		read, err := source.Read(buf)
-		if err != nil {
-			return -1, fmt.Errorf("could not read %s: %v", fileName, err)
-		}
-		if read != h2mg.HeaderSize {
-			return -1, fmt.Errorf("%s: unexpected read length (expected %d, got %d)",
-				fileName, h2mg.HeaderSize, read)
-		}
-		sourceHeader, err := h2mg.Parse2MG(buf)
-		if err != nil {
-			return -1, fmt.Errorf("could not parse %s header: %v", fileName, err)
-		}
-		err = sourceHeader.Validate()
-		if err != nil {
-			return -1, fmt.Errorf("%s: could not validate: %v", fileName, err)
-		}
-		// Move to beginning of data - we should already be
-		// there but this doesn't hurt
-		_, err = source.Seek(int64(sourceHeader.Offset), os.SEEK_SET)
-		if err != nil {
-			return length, fmt.Errorf("could not seek to data for %s: %v", fileName, err)
-		}
-		return int64(sourceHeader.Length), nil
-	case "hdv", "po":
-		return fi.Size(), nil
-		// For the source image, if it's HDV, there's no seek
-		// required because we haven't read anything
-	default:
-		return -1, fmt.Errorf("unknown image format %s", targetType)
+	if blocks <= int64(vol.TotalBlocks) {
+		fmt.Fprintf(os.Stderr, "Volume /%s already fills the partition (%d blocks)\n",
+			vol.Name, vol.TotalBlocks)
+		return nil
 	}
+	if _, err = prodos.Resize(device, int(blocks)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Expanded volume /%s from %d to %d blocks\n",
+		vol.Name, vol.TotalBlocks, blocks)
+	return nil
+}
+
+// imageFile is a readable source image file, such as an *os.File or a
+// member of a zip archive
+type imageFile interface {
+	io.ReaderAt
+	io.Closer
+	Name() string
 }
 
-// Pick output format based on filename and return as a string
-func imageAutoDetect(filename string) string {
-	var filetype string
+// sourceImage is a source disk image opened for reading, positioned at
+// the start of its disk data.
+type sourceImage struct {
+	io.Reader
+	Length int64 // Length of disk data, minus headers; -1 if unknown
+
+	file imageFile
+}
+
+// Close closes the underlying source file
+func (s sourceImage) Close() error {
+	return s.file.Close()
+}
 
-	// Get file suffix
-	fileparts := strings.Split(filename, ".")
-	if len(fileparts) == 1 {
-		return ""
+// openSourceImage opens a source image of the given type for reading,
+// and gets its length. With a type of "auto", the format is detected
+// from the image content. Compressed images are read transparently, and
+// images inside zip archives may be named as archive.zip:member. A
+// sourceFile of - reads stdin, whose type must be given, and whose
+// length is unknown unless the image has a header giving it.
+func openSourceImage(sourceFile, sourceType string) (source sourceImage, err error) {
+	stream := sourceFile == stdioName
+	if stream {
+		if sourceType == "auto" {
+			return source, fmt.Errorf("--type is required when reading from stdin")
+		}
+		source.file = newStreamSource(os.Stdin, "stdin")
+	} else if archive, member, ok := splitArchive(sourceFile); ok {
+		source.file, err = openArchiveMember(archive, member)
+	} else {
+		source.file, err = os.Open(sourceFile)
+	}
+	if err != nil {
+		return
+	}
+
+	img, err := diskimage.Open(source.file, source.file.Name(), sourceType)
+	if err != nil {
+		source.file.Close()
+		return
+	}
+	if img.Format.Name() == "mdt" {
+		source.file.Close()
+		return source, fmt.Errorf("%s is a whole Microdrive/Turbo image; export a partition from it first",
+			sourceFile)
 	}
-	suffix := fileparts[len(fileparts)-1]
-	switch strings.ToLower(suffix) {
-	default:
-		filetype = suffix // this will work or fail independently
+	if sourceType == "auto" {
+		fmt.Fprintf(os.Stderr, "Detected %s as %s\n", sourceFile, img.Description)
 	}
-	return strings.ToLower(filetype)
+
+	source.Length = img.Length
+	if source.Length < 0 && stream {
+		source.Reader = io.NewSectionReader(img.ReaderAt, 0, math.MaxInt64)
+		return
+	}
+	if source.Length < 0 {
+		source.Length, err = diskimage.Size(img.ReaderAt)
+		if err != nil {
+			source.file.Close()
+			return source, fmt.Errorf("could not get source length for %s: %v", sourceFile, err)
+		}
+	}
+	source.Reader = io.NewSectionReader(img.ReaderAt, 0, source.Length)
+	return
 }
 
-func getTarget(targetFile string, force bool) (target *os.File, partMap mdturbo.MDTurbo, err error) {
+func getTarget(targetFile string, force bool) (target *targetCard, partMap mdturbo.MDTurbo, err error) {
+	if err = refuseCompressed(targetFile); err != nil {
+		return
+	}
 
 	// Get the partition table
 	partMap, err = GetPartitionTable(targetFile)
@@ -159,9 +303,7 @@ func getTarget(targetFile string, force bool) (target *os.File, partMap mdturbo.
 	}
 
 	// Open the target file passed in for writing
-	target, err = os.OpenFile(
-		targetFile,
-		os.O_RDWR, 0666)
+	target, err = openTarget(targetFile, false)
 	if err != nil {
 		err = fmt.Errorf("could not open %s: %v", targetFile, err)
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/prodos"
+)
+
+// autoPartition is the --partition value asking for the best free fit
+const autoPartition = "auto"
+
+// unformattedBlocks is how many blocks at the start of a partition must
+// be zero for it to count as unformatted
+const unformattedBlocks = 16
+
+// partitionContents describes what a partition holds: "unformatted",
+// "empty" for a ProDOS volume with no files, or a description of what
+// is there. free is true if it's safe to overwrite.
+func partitionContents(partition io.ReaderAt) (description string, free bool) {
+	vol, err := prodos.ReadVolume(partition)
+	if err == nil {
+		if vol.FileCount == 0 {
+			return fmt.Sprintf("empty volume /%s", vol.Name), true
+		}
+		return fmt.Sprintf("volume /%s with %d files", vol.Name, vol.FileCount), false
+	}
+	start := make([]byte, unformattedBlocks*prodos.BlockSize)
+	read, err := partition.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Sprintf("unreadable: %v", err), false
+	}
+	if bytes.Count(start[:read], []byte{0}) == read {
+		return "unformatted", true
+	}
+	return "unknown data", false
+}
+
+// choosePartition picks the smallest free partition of a card that the
+// source image fits in, and confirms it with the user.
+func choosePartition(source sourceImage, sourceFile, targetFile string, yes bool) (partNum uint8, err error) {
+	length := source.Length
+	if length < 0 {
+		return 0, fmt.Errorf("the size of %s is unknown; give a partition number", source.file.Name())
+	}
+
+	partMap, err := GetPartitionTable(targetFile)
+	if err != nil {
+		return
+	}
+	card, err := openCardImage(targetFile)
+	if err != nil {
+		return
+	}
+	defer card.Close()
+
+	best := -1
+	var bestPartition mdturbo.Partition
+	var bestContents string
+	for num := uint8(0); num < partMap.PartCount(); num++ {
+		partition, err := partMap.GetPartition(num)
+		if err != nil {
+			return 0, err
+		}
+		size := int64(partition.Length()) * mdturbo.SectorSize
+		contents, free := partitionContents(io.NewSectionReader(card,
+			int64(partition.Start)*mdturbo.SectorSize, size))
+		fmt.Fprintf(os.Stderr, "Partition %d: %dK, %s\n", num, partition.Length()/2, contents)
+		if !free || size < length {
+			continue
+		}
+		if best == -1 || partition.Length() < bestPartition.Length() {
+			best, bestPartition, bestContents = int(num), partition, contents
+		}
+	}
+	if best == -1 {
+		return 0, fmt.Errorf("no free partition on %s is large enough for %s (%dK)",
+			targetFile, sourceFile, length/1024)
+	}
+
+	ok, err := confirm(fmt.Sprintf("Import %s into partition %d (%dK, %s)?",
+		sourceFile, best, bestPartition.Length()/2, bestContents), yes)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("import cancelled")
+	}
+	return uint8(best), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/journal"
+	"github.com/disappearinjon/microdrive/manifest"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/transfer"
+)
+
+// importManifest writes every image listed in a manifest to a card in
+// one pass. All sources are opened and checked against the partition
+// table before anything is written, and the partition table is only
+// updated once every image has been copied.
+func importManifest(ctx context.Context, manifestFile, targetFile string, opts importOptions) error {
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return err
+	}
+	entries, err := manifest.Parse(data, filepath.Dir(manifestFile))
+	if err != nil {
+		return fmt.Errorf("could not read manifest %s: %v", manifestFile, err)
+	}
+
+	// Open every source, to learn its size
+	sources := make([]sourceImage, 0, len(entries))
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+	for _, entry := range entries {
+		source, err := openSourceImage(entry.Source, entry.Type)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+
+	target, partMap, err := getTarget(targetFile, opts.Force)
+	if err != nil {
+		return fmt.Errorf("could not open target %s: %v", targetFile, err)
+	}
+	defer target.Close()
+	original := partMap
+
+	// Work out where everything goes, adding new partitions to our
+	// copy of the table as we go
+	partNums := make([]uint8, len(entries))
+	claimed := make(map[uint8]string)
+	for i, entry := range entries {
+		length := sources[i].Length
+		if entry.Partition == manifest.NewPartition {
+			blocks := (length + mdturbo.SectorSize - 1) / mdturbo.SectorSize
+			if blocks == 0 {
+				return fmt.Errorf("nonsense size for file %s", entry.Source)
+			}
+			partNum, err := partMap.AddPartition(uint32(blocks))
+			if err != nil {
+				return fmt.Errorf("could not add a partition for %s: %v", entry.Source, err)
+			}
+			partNums[i] = uint8(partNum)
+		} else {
+			partNums[i], err = entry.PartitionNumber()
+			if err != nil {
+				return err
+			}
+			if partNums[i] >= partMap.PartCount() {
+				return fmt.Errorf("%s: requested partition %d but max partition is %d",
+					entry.Source, partNums[i], partMap.PartCount()-1)
+			}
+			partition, err := partMap.GetPartition(partNums[i])
+			if err != nil {
+				return fmt.Errorf("failed to get partition: %v", err)
+			}
+			if length > int64(partition.Length())*mdturbo.SectorSize {
+				return fmt.Errorf("%s (%d) larger than target partition %d (%d)",
+					entry.Source, length, partNums[i], partition.Length()*mdturbo.SectorSize)
+			}
+		}
+		if other, ok := claimed[partNums[i]]; ok {
+			return fmt.Errorf("%s and %s are both for partition %d", other, entry.Source, partNums[i])
+		}
+		claimed[partNums[i]] = entry.Source
+	}
+
+	// New partitions must all fit, before the first image is written.
+	// Without the geometry, a card image just grows.
+	if partMap.Capacity() != 0 || target.device != nil {
+		free := freeSectors(target, original)
+		needed := int64(partMap.FirstFree()) - int64(original.FirstFree())
+		if free >= 0 && needed > free {
+			return fmt.Errorf("new partitions need %d blocks; %s has %d blocks free",
+				needed, targetFile, free)
+		}
+	}
+
+	if cli.DryRun {
+		var writes []plannedWrite
+		for i, entry := range entries {
+			partition, err := partMap.GetPartition(partNums[i])
+			if err != nil {
+				return fmt.Errorf("failed to get partition: %v", err)
+			}
+			entryOpts := opts
+			entryOpts.Expand = opts.Expand || entry.Expand
+			writes = append(writes, importWrites(partition, partNums[i], sources[i].Length, entryOpts)...)
+		}
+		if partMap != original {
+			writes = append(writes, tableWrite)
+		}
+		dryRun(targetFile, original, partMap, writes)
+		return nil
+	}
+
+	// Save everything that's about to change
+	ranges := []journal.Range{tableRange}
+	for _, partNum := range partNums {
+		partition, err := partMap.GetPartition(partNum)
+		if err != nil {
+			return fmt.Errorf("failed to get partition: %v", err)
+		}
+		ranges = append(ranges, partitionRange(partition))
+	}
+	if err = saveUndo(target, ranges...); err != nil {
+		return err
+	}
+
+	// Copy everything
+	for i, entry := range entries {
+		partition, err := partMap.GetPartition(partNums[i])
+		if err != nil {
+			return fmt.Errorf("failed to get partition: %v", err)
+		}
+		entryOpts := opts
+		entryOpts.Expand = opts.Expand || entry.Expand
+		if err = copyImage(ctx, target, partition, partNums[i], sources[i], entryOpts); err != nil {
+			if partMap != original {
+				return fmt.Errorf("could not import %s: %v; no partitions were added", entry.Source, err)
+			}
+			return fmt.Errorf("could not import %s: %v", entry.Source, err)
+		}
+		fmt.Fprintf(os.Stderr, "Imported %s to partition %d\n", entry.Source, partNums[i])
+	}
+
+	// Only now that every image is in place, update the table
+	if partMap != original {
+		if err = transfer.WriteTable(target, partMap); err != nil {
+			return fmt.Errorf("could not update partition table on %s: %v", targetFile, err)
+		}
+	}
+	return target.Commit()
+}
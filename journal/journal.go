@@ -0,0 +1,239 @@
+// Package journal keeps an undo journal for a Microdrive/Turbo card
+// image: before a command changes the card, the original contents of
+// every byte range it is about to overwrite are saved to a sidecar
+// file, so the change can later be undone.
+//
+// A journal is a sequence of operations. Each is a single line of JSON
+// describing the operation and the ranges it saved, followed by the
+// saved data of each range, in order.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Suffix is added to a card image's filename to name its journal
+const Suffix = ".undo"
+
+// Range is a range of bytes on a card
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Operation describes one change to a card, and what it overwrote
+type Operation struct {
+	Number  int       `json:"number"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Size    int64     `json:"size"`   // Size of the card beforehand, or -1
+	Ranges  []Range   `json:"ranges"` // Ranges saved, in journal order
+
+	start int64 // Offset of the operation in the journal
+	data  int64 // Offset of its saved data in the journal
+}
+
+// Filename returns the name of the journal for a card image
+func Filename(card string) string {
+	return card + Suffix
+}
+
+// syncer is a card that can flush its writes to stable storage
+type syncer interface {
+	Sync() error
+}
+
+// truncater is a card whose size can be changed, such as an *os.File
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// Save records the current contents of ranges of a card as a new
+// operation at the end of a journal, creating the journal if need be.
+// size is the size of the card, or -1 if that has no meaning, as for a
+// device; ranges past its end are saved only as far as the card goes.
+// The journal is synced to stable storage before Save returns.
+func Save(journalFile string, card io.ReaderAt, size int64, command string, ranges []Range) (op Operation, err error) {
+	ops, err := List(journalFile)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	op = Operation{Number: 1, Time: time.Now().UTC(), Command: command, Size: size}
+	if len(ops) > 0 {
+		op.Number = ops[len(ops)-1].Number + 1
+	}
+	for _, r := range ranges {
+		if size >= 0 && r.Offset+r.Length > size {
+			r.Length = size - r.Offset
+		}
+		if r.Length > 0 {
+			op.Ranges = append(op.Ranges, r)
+		}
+	}
+
+	file, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	header, err := json.Marshal(op)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(append(header, '\n')); err != nil {
+		return
+	}
+	for _, r := range op.Ranges {
+		copied, err := io.Copy(file, io.NewSectionReader(card, r.Offset, r.Length))
+		if err == nil && copied != r.Length {
+			err = fmt.Errorf("read %d bytes at %d; expected %d", copied, r.Offset, r.Length)
+		}
+		if err != nil {
+			// Don't leave a partial operation behind
+			file.Truncate(end)
+			return op, fmt.Errorf("could not save card data: %v", err)
+		}
+	}
+	if err = file.Sync(); err != nil {
+		return
+	}
+	return op, file.Close()
+}
+
+// List returns the operations in a journal, oldest first
+func List(journalFile string) (ops []Operation, err error) {
+	file, err := os.Open(journalFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("journal %s is damaged: %v", journalFile, err)
+		}
+		var op Operation
+		if err = json.Unmarshal(line, &op); err != nil {
+			return nil, fmt.Errorf("journal %s is damaged: %v", journalFile, err)
+		}
+		op.start, op.data = offset, offset+int64(len(line))
+		offset = op.data
+		for _, r := range op.Ranges {
+			offset += r.Length
+		}
+		if _, err = reader.Discard(int(offset - op.data)); err != nil {
+			return nil, fmt.Errorf("journal %s is damaged: operation %d is incomplete",
+				journalFile, op.Number)
+		}
+		ops = append(ops, op)
+	}
+}
+
+// Pending returns the operations that undoing operation number would
+// undo: it and every later operation, latest first
+func Pending(journalFile string, number int) ([]Operation, error) {
+	ops, err := List(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.Number == number {
+			pending := make([]Operation, 0, len(ops)-i)
+			for j := len(ops) - 1; j >= i; j-- {
+				pending = append(pending, ops[j])
+			}
+			return pending, nil
+		}
+	}
+	return nil, fmt.Errorf("journal %s has no operation %d", journalFile, number)
+}
+
+// Restore writes the data saved by operations back to a card, in the
+// order given. The journal is left as it is.
+func Restore(journalFile string, card io.WriterAt, ops []Operation) error {
+	file, err := os.Open(journalFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, op := range ops {
+		if err = restore(file, card, op); err != nil {
+			return fmt.Errorf("could not undo operation %d: %v", op.Number, err)
+		}
+	}
+	if s, ok := card.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Undo restores a card to how it was before operation number, undoing
+// it and every later operation, latest first. Those operations are then
+// removed from the journal, and the journal is deleted if that leaves
+// it empty. Returns the operations undone, latest first.
+func Undo(journalFile string, card io.WriterAt, number int) (undone []Operation, err error) {
+	undone, err = Pending(journalFile, number)
+	if err != nil {
+		return nil, err
+	}
+	if err = Restore(journalFile, card, undone); err != nil {
+		return nil, err
+	}
+	return undone, Forget(journalFile, undone)
+}
+
+// Forget removes operations returned by Pending from a journal, once
+// they've been undone. The journal is deleted if that leaves it empty.
+func Forget(journalFile string, pending []Operation) error {
+	first := pending[len(pending)-1]
+	if first.start == 0 {
+		return os.Remove(journalFile)
+	}
+	return os.Truncate(journalFile, first.start)
+}
+
+// restore writes the data saved by an operation back to a card
+func restore(journal io.ReaderAt, card io.WriterAt, op Operation) error {
+	offset := op.data
+	for _, r := range op.Ranges {
+		dst := &offsetWriter{card, r.Offset}
+		copied, err := io.Copy(dst, io.NewSectionReader(journal, offset, r.Length))
+		if err == nil && copied != r.Length {
+			err = fmt.Errorf("restored %d bytes at %d; expected %d", copied, r.Offset, r.Length)
+		}
+		if err != nil {
+			return err
+		}
+		offset += r.Length
+	}
+	if t, ok := card.(truncater); ok && op.Size >= 0 {
+		return t.Truncate(op.Size)
+	}
+	return nil
+}
+
+// offsetWriter writes to a card sequentially, from an offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	written, err := o.w.WriteAt(b, o.offset)
+	o.offset += int64(written)
+	return written, err
+}
@@ -0,0 +1,139 @@
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newCard writes a card image of size bytes, each holding fill, to a
+// temporary directory, and returns it open along with its journal name
+func newCard(t *testing.T, size int, fill byte) (*os.File, string) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	name := filepath.Join(dir, "card.mdt")
+	if err = ioutil.WriteFile(name, bytes.Repeat([]byte{fill}, size), 0666); err != nil {
+		t.Fatalf("could not write card: %v", err)
+	}
+	card, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("could not open card: %v", err)
+	}
+	return card, Filename(name)
+}
+
+// contents returns the whole of a card
+func contents(t *testing.T, card *os.File) []byte {
+	data, err := ioutil.ReadFile(card.Name())
+	if err != nil {
+		t.Fatalf("could not read card: %v", err)
+	}
+	return data
+}
+
+func TestUndo(t *testing.T) {
+	card, journalFile := newCard(t, 4096, 0x11)
+	defer os.RemoveAll(filepath.Dir(card.Name()))
+	defer card.Close()
+	original := contents(t, card)
+
+	// First operation overwrites the start of the card
+	op, err := Save(journalFile, card, 4096, "first", []Range{{0, 512}})
+	if err != nil || op.Number != 1 {
+		t.Fatalf("could not save first operation %d: %v", op.Number, err)
+	}
+	card.WriteAt(bytes.Repeat([]byte{0x22}, 512), 0)
+	afterFirst := contents(t, card)
+
+	// Second overwrites some more and grows the card
+	op, err = Save(journalFile, card, 4096, "second", []Range{{0, 512}, {3584, 1024}})
+	if err != nil || op.Number != 2 {
+		t.Fatalf("could not save second operation %d: %v", op.Number, err)
+	}
+	if len(op.Ranges) != 2 || op.Ranges[1].Length != 512 {
+		t.Errorf("range past the end of the card not cut short: %+v", op.Ranges)
+	}
+	card.WriteAt(bytes.Repeat([]byte{0x33}, 512), 0)
+	card.WriteAt(bytes.Repeat([]byte{0x33}, 1024), 3584)
+
+	ops, err := List(journalFile)
+	if err != nil || len(ops) != 2 || ops[1].Command != "second" {
+		t.Fatalf("unexpected journal %+v: %v", ops, err)
+	}
+
+	undone, err := Undo(journalFile, card, 2)
+	if err != nil || len(undone) != 1 || undone[0].Number != 2 {
+		t.Fatalf("undo of the last operation returned %+v: %v", undone, err)
+	}
+	if !bytes.Equal(contents(t, card), afterFirst) {
+		t.Errorf("card not restored to how it was after the first operation")
+	}
+	if ops, err = List(journalFile); err != nil || len(ops) != 1 {
+		t.Errorf("journal has %d operations after undo, expected 1: %v", len(ops), err)
+	}
+
+	if _, err = Undo(journalFile, card, 1); err != nil {
+		t.Fatalf("undo of the first operation failed: %v", err)
+	}
+	if !bytes.Equal(contents(t, card), original) {
+		t.Errorf("card not restored to its original contents")
+	}
+	if _, err = os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Errorf("empty journal was not removed")
+	}
+}
+
+func TestUndoSeveral(t *testing.T) {
+	card, journalFile := newCard(t, 1024, 0)
+	defer os.RemoveAll(filepath.Dir(card.Name()))
+	defer card.Close()
+	original := contents(t, card)
+
+	for i := 1; i <= 3; i++ {
+		if _, err := Save(journalFile, card, 1024, "change", []Range{{int64(i) * 100, 100}}); err != nil {
+			t.Fatalf("could not save operation %d: %v", i, err)
+		}
+		card.WriteAt(bytes.Repeat([]byte{byte(i)}, 150), int64(i)*100)
+	}
+	undone, err := Undo(journalFile, card, 2)
+	if err != nil || len(undone) != 2 || undone[0].Number != 3 {
+		t.Fatalf("undo from operation 2 returned %+v: %v", undone, err)
+	}
+	// Only the saved ranges are restored, so what each operation wrote
+	// past its range is what the next one saved, or is left alone
+	expected := append([]byte(nil), original...)
+	copy(expected[100:250], bytes.Repeat([]byte{1}, 150))
+	copy(expected[300:350], bytes.Repeat([]byte{2}, 50))
+	copy(expected[400:450], bytes.Repeat([]byte{3}, 50))
+	if !bytes.Equal(contents(t, card), expected) {
+		t.Errorf("card not restored as expected")
+	}
+	if ops, err := List(journalFile); err != nil || len(ops) != 1 {
+		t.Errorf("journal has %d operations, expected 1: %v", len(ops), err)
+	}
+	if _, err = Undo(journalFile, card, 1); err != nil {
+		t.Fatalf("undo of operation 1 failed: %v", err)
+	}
+	if _, err = Undo(journalFile, card, 1); err == nil {
+		t.Errorf("undo with an empty journal succeeded")
+	}
+}
+
+func TestListDamaged(t *testing.T) {
+	card, journalFile := newCard(t, 1024, 0)
+	defer os.RemoveAll(filepath.Dir(card.Name()))
+	defer card.Close()
+	if _, err := Save(journalFile, card, 1024, "change", []Range{{0, 512}}); err != nil {
+		t.Fatalf("could not save operation: %v", err)
+	}
+	if err := os.Truncate(journalFile, 300); err != nil {
+		t.Fatalf("could not truncate journal: %v", err)
+	}
+	if _, err := List(journalFile); err == nil {
+		t.Errorf("damaged journal listed without error")
+	}
+}
@@ -0,0 +1,197 @@
+// Package lock takes advisory locks on card images, so that a command
+// changing a card can't run while another command is using it.
+//
+// Locks are taken on a sidecar file beside the card, named after it
+// with ".lock" added, rather than on the card itself, since a card may
+// be replaced by a changed copy while it's locked. Each holder writes
+// its process ID into the lock file, one per line, so anyone kept
+// waiting can be told who has the card. The last holder to finish
+// removes the lock file.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Suffix is added to a card image's filename to name its lock file
+const Suffix = ".lock"
+
+// retryInterval is how often a busy lock is tried again
+const retryInterval = 100 * time.Millisecond
+
+// Filename returns the usual name of the lock file for a card image
+func Filename(card string) string {
+	return card + Suffix
+}
+
+// LockedError is returned when a lock can't be taken in time
+type LockedError struct {
+	Card string
+	PIDs []int // Processes holding the lock, if known
+}
+
+func (e *LockedError) Error() string {
+	switch len(e.PIDs) {
+	case 0:
+		return fmt.Sprintf("%s is in use by another command", e.Card)
+	case 1:
+		return fmt.Sprintf("%s is locked by process %d", e.Card, e.PIDs[0])
+	}
+	pids := make([]string, len(e.PIDs))
+	for i, pid := range e.PIDs {
+		pids[i] = strconv.Itoa(pid)
+	}
+	return fmt.Sprintf("%s is in use by processes %s", e.Card, strings.Join(pids, ", "))
+}
+
+// Lock is a lock held on a card
+type Lock struct {
+	file      *os.File // Nil if the card couldn't be locked
+	name      string   // Name of the lock file
+	exclusive bool
+}
+
+// errNoLockFile is returned by take when a shared lock has no lock file
+// to use, and the card should be read without a lock
+var errNoLockFile = errors.New("no lock file")
+
+// Exclusive takes an exclusive lock on a card, for changing it, using
+// the given lock file, normally Filename(card). It waits up to wait for
+// other commands to finish with the card.
+func Exclusive(card, lockFile string, wait time.Duration) (*Lock, error) {
+	l := &Lock{name: lockFile, exclusive: true}
+	if err := l.take(card, os.O_RDWR|os.O_CREATE, wait); err != nil {
+		return nil, err
+	}
+	l.file.Truncate(0)
+	l.file.WriteAt(pidLine(), 0)
+	return l, nil
+}
+
+// Shared takes a shared lock on a card, for reading it, using the given
+// lock file, waiting up to wait for any command changing it to finish.
+// A card that doesn't exist gets no lock file, unless a command creating
+// it already made one. If there's no lock file and one can't be made, as
+// on read-only media, the card is read without a lock.
+func Shared(card, lockFile string, wait time.Duration) (*Lock, error) {
+	// Appending keeps other holders' lines intact
+	flag := os.O_RDWR | os.O_APPEND
+	if _, err := os.Stat(card); err == nil {
+		flag |= os.O_CREATE
+	}
+	l := &Lock{name: lockFile}
+	err := l.take(card, flag, wait)
+	if err == errNoLockFile {
+		return &Lock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.file.Write(pidLine())
+	return l, nil
+}
+
+// pidLine is this process's line in a lock file
+func pidLine() []byte {
+	return []byte(strconv.Itoa(os.Getpid()) + "\n")
+}
+
+// take opens the lock file with flag and takes the lock, trying again
+// until wait has passed
+func (l *Lock) take(card string, flag int, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		file, err := os.OpenFile(l.name, flag, 0666)
+		if err != nil && !l.exclusive {
+			file, err = os.Open(l.name)
+		}
+		if err != nil {
+			if !l.exclusive {
+				return errNoLockFile
+			}
+			return fmt.Errorf("could not lock %s: %v", card, err)
+		}
+		busy, err := tryLock(file, l.exclusive)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("could not lock %s: %v", card, err)
+		}
+		if !busy {
+			// The last holder removes the lock file as it finishes, so
+			// the one locked may no longer be the one in use; if so,
+			// start again with the new one
+			if current(file, l.name) {
+				l.file = file
+				return nil
+			}
+			unlock(file)
+			file.Close()
+			continue
+		}
+		pids := holders(file)
+		file.Close()
+		if time.Now().After(deadline) {
+			return &LockedError{Card: card, PIDs: pids}
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// current returns true if an open lock file is still the one at name
+func current(file *os.File, name string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	named, err := os.Stat(name)
+	return err == nil && os.SameFile(opened, named)
+}
+
+// holders returns the running processes listed in a lock file. A
+// shared holder that finished while others still held the lock may
+// have left its line behind, so processes no longer running are left
+// out.
+func holders(file *os.File) (pids []int) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, 0, 4096))
+	if err != nil {
+		return nil
+	}
+	seen := make(map[int]bool)
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil || pid <= 0 || seen[pid] || !running(pid) {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// Release gives up a lock. The last holder out removes the lock file;
+// a shared holder only knows it's the last if it can take the lock
+// exclusively.
+func (l *Lock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	last := l.exclusive
+	if !last {
+		busy, err := tryLock(l.file, true)
+		last = err == nil && !busy
+	}
+	if last && os.Remove(l.name) != nil {
+		l.file.Truncate(0)
+	}
+	unlock(l.file)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,141 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCard makes an empty card image in a temporary directory, and
+// returns its name
+func newCard(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatalf("could not make temporary directory: %v", err)
+	}
+	card := filepath.Join(dir, "card.mdt")
+	if err = ioutil.WriteFile(card, nil, 0666); err != nil {
+		t.Fatalf("could not make card: %v", err)
+	}
+	return card
+}
+
+// gone checks that a card's lock file has been removed
+func gone(t *testing.T, card string) {
+	if _, err := os.Stat(Filename(card)); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind after every lock was released")
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	card := newCard(t)
+	defer os.RemoveAll(filepath.Dir(card))
+
+	held, err := Exclusive(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take exclusive lock: %v", err)
+	}
+	_, err = Exclusive(card, Filename(card), 0)
+	locked, ok := err.(*LockedError)
+	if !ok {
+		t.Fatalf("second exclusive lock returned %v, expected a LockedError", err)
+	}
+	if len(locked.PIDs) != 1 || locked.PIDs[0] != os.Getpid() {
+		t.Errorf("lock holders reported as %v, expected %d", locked.PIDs, os.Getpid())
+	}
+	if _, err = Shared(card, Filename(card), 0); err == nil {
+		t.Errorf("shared lock taken while exclusively locked")
+	}
+
+	// Waiting succeeds once the lock is released, and the waiter holds
+	// the lock file that's now in use, not the one removed
+	go func() {
+		time.Sleep(2 * retryInterval)
+		held.Release()
+	}()
+	again, err := Exclusive(card, Filename(card), time.Minute)
+	if err != nil {
+		t.Fatalf("waiting for exclusive lock failed: %v", err)
+	}
+	if _, err = Exclusive(card, Filename(card), 0); err == nil {
+		t.Errorf("exclusive lock taken while a waiter held it")
+	}
+	again.Release()
+	gone(t, card)
+}
+
+func TestShared(t *testing.T) {
+	card := newCard(t)
+	defer os.RemoveAll(filepath.Dir(card))
+
+	first, err := Shared(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take shared lock: %v", err)
+	}
+	second, err := Shared(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take second shared lock: %v", err)
+	}
+	_, err = Exclusive(card, Filename(card), retryInterval)
+	if locked, ok := err.(*LockedError); !ok || len(locked.PIDs) != 1 || locked.PIDs[0] != os.Getpid() {
+		t.Errorf("exclusive lock while shared returned %v, expected a LockedError naming this process", err)
+	}
+	first.Release()
+	if _, err = os.Stat(Filename(card)); err != nil {
+		t.Errorf("lock file removed while a shared lock was held: %v", err)
+	}
+	second.Release()
+	gone(t, card)
+
+	held, err := Exclusive(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take exclusive lock after shared locks released: %v", err)
+	}
+	held.Release()
+}
+
+func TestSharedMissingCard(t *testing.T) {
+	card := newCard(t)
+	defer os.RemoveAll(filepath.Dir(card))
+	os.Remove(card)
+
+	l, err := Shared(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take shared lock on a missing card: %v", err)
+	}
+	gone(t, card)
+	l.Release()
+
+	// A command creating the card still keeps readers out
+	held, err := Exclusive(card, Filename(card), 0)
+	if err != nil {
+		t.Fatalf("could not take exclusive lock on a missing card: %v", err)
+	}
+	if _, err = Shared(card, Filename(card), 0); err == nil {
+		t.Errorf("shared lock taken on a missing card while it was being created")
+	}
+	held.Release()
+	gone(t, card)
+}
+
+func TestLockedError(t *testing.T) {
+	tests := []struct {
+		pids     []int
+		expected string
+	}{
+		{nil, "card.mdt is in use by another command"},
+		{[]int{12}, "card.mdt is locked by process 12"},
+		{[]int{12, 34}, "card.mdt is in use by processes 12, 34"},
+	}
+	for _, test := range tests {
+		err := &LockedError{Card: "card.mdt", PIDs: test.pids}
+		if err.Error() != test.expected {
+			t.Errorf("error for %v is %q, expected %q", test.pids, err.Error(), test.expected)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lock
+
+import (
+	"os"
+)
+
+// tryLock does nothing where flock isn't available; cards aren't locked
+func tryLock(file *os.File, exclusive bool) (busy bool, err error) {
+	return false, nil
+}
+
+// unlock does nothing where flock isn't available
+func unlock(file *os.File) error {
+	return nil
+}
+
+// running assumes a process exists, as there's no portable way to ask
+func running(pid int) bool {
+	return true
+}
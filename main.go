@@ -1,19 +1,34 @@
 package main
 
+import "context"
 import "fmt"
 import "os"
+import "os/signal"
+import "time"
 
 import "github.com/alexflint/go-arg"
 
 // CLI flags and values
 
 type args struct {
-	Append *AppendCmd `arg:"subcommand:append"`
-	Diff   *DiffCmd   `arg:"subcommand:diff"`
-	Export *ExportCmd `arg:"subcommand:export"`
-	Import *ImportCmd `arg:"subcommand:import"`
-	Read   *ReadCmd   `arg:"subcommand:read"`
-	Write  *WriteCmd  `arg:"subcommand:write"`
+	Append     *AppendCmd     `arg:"subcommand:append"`
+	Applypatch *ApplypatchCmd `arg:"subcommand:applypatch"`
+	Devices    *DevicesCmd    `arg:"subcommand:devices"`
+	Diff       *DiffCmd       `arg:"subcommand:diff"`
+	Export     *ExportCmd     `arg:"subcommand:export"`
+	Import     *ImportCmd     `arg:"subcommand:import"`
+	Mkpatch    *MkpatchCmd    `arg:"subcommand:mkpatch"`
+	Read       *ReadCmd       `arg:"subcommand:read"`
+	Sync       *SyncCmd       `arg:"subcommand:sync"`
+	Undo       *UndoCmd       `arg:"subcommand:undo"`
+	Write      *WriteCmd      `arg:"subcommand:write"`
+
+	Progress    string        `help:"Progress reporting for long copies: auto (on a terminal), json, none" default:"auto"`
+	NoJournal   bool          `arg:"--no-journal" help:"Don't save undo information before changing a card" default:"false"`
+	DryRun      bool          `arg:"--dry-run" help:"Show what would change on the card, without changing it" default:"false"`
+	CopyOnWrite bool          `arg:"--copy-on-write" help:"Change a copy of the card image, and rename it over the original only once every change is made" default:"false"`
+	Device      bool          `arg:"--device" help:"Allow changes to a block device, such as a CF card at /dev/sdb" default:"false"`
+	Wait        time.Duration `help:"How long to wait for another command to finish with the card, such as 30s; by default, don't wait" default:"0s"`
 }
 
 func (args) Description() string {
@@ -22,29 +37,67 @@ func (args) Description() string {
 
 var cli args
 
+// interruptContext returns a context that is cancelled by the first
+// interrupt, so long copies can stop cleanly; a second interrupt kills
+// the program as usual
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		fmt.Fprintln(os.Stderr, "\nInterrupted; stopping")
+		cancel()
+	}()
+	return ctx
+}
+
 func main() {
 	var err error
 	parsed := arg.MustParse(&cli)
+	switch cli.Progress {
+	case progressAuto, progressJSON, progressNone:
+	default:
+		parsed.Fail("--progress must be auto, json or none")
+	}
 	subcommand := parsed.SubcommandNames()
 	if len(subcommand) != 1 {
 		parsed.Fail("Must specify a command")
 	}
+	locks, err := lockCards(subcommand[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	ctx := interruptContext()
 	switch subcommand[0] {
 	case "append":
-		err = appendPartition()
+		err = appendPartition(ctx)
+	case "applypatch":
+		err = applyPatch(ctx)
+	case "devices":
+		err = listDevices()
 	case "diff":
 		err = diffPartitions()
 	case "export":
-		err = exportPartition()
+		err = exportPartition(ctx)
 	case "import":
-		err = importPartition()
+		err = importPartition(ctx)
+	case "mkpatch":
+		err = makePatch(ctx)
 	case "read":
 		err = readPartition()
+	case "sync":
+		err = syncCard(ctx)
+	case "undo":
+		err = undoOperation()
 	case "write":
 		err = writePartition()
 	default:
 		parsed.Fail("Unknown command")
 	}
+	releaseCards(locks)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
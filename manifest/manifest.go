@@ -0,0 +1,155 @@
+// Package manifest parses card manifests: lists of disk images to be
+// written to a Microdrive/Turbo card, each with the partition to write
+// it to.
+//
+// Manifests are YAML, as in:
+//
+//	images:
+//	  - source: system.po
+//	    partition: 0
+//	  - source: games.2mg
+//	    partition: new
+//	    expand: true
+//
+// The list of entries may also be given on its own, without the
+// "images" key. JSON manifests are accepted too, including those
+// written by "export --all", so a card can be rebuilt from its backup.
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// NewPartition is the Partition value asking for a new partition
+const NewPartition = "new"
+
+// Entry is one image to be written to a card
+type Entry struct {
+	Source    string // Image filename, relative to the manifest
+	Partition string // Partition number, or NewPartition
+	Type      string // Image type, or "auto"
+	Expand    bool   // Grow the ProDOS volume to fill the partition
+}
+
+// PartitionNumber returns the partition number of an entry that
+// doesn't ask for a new partition
+func (e Entry) PartitionNumber() (uint8, error) {
+	num, err := strconv.ParseUint(e.Partition, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("bad partition %q for %s", e.Partition, e.Source)
+	}
+	return uint8(num), nil
+}
+
+// entryFields are the keys an entry may have. Sources are also
+// accepted as "file", and types as "format", as written by "export
+// --all"; the other keys that writes have no meaning when writing images
+// back to a card, and are ignored.
+type entryFields struct {
+	Source    string `yaml:"source"`
+	File      string `yaml:"file"`
+	Partition string `yaml:"partition"`
+	Type      string `yaml:"type"`
+	Format    string `yaml:"format"`
+	Expand    bool   `yaml:"expand"`
+
+	Compression interface{} `yaml:"compression"`
+	Volume      interface{} `yaml:"volume"`
+	Start       interface{} `yaml:"start"`
+	Sectors     interface{} `yaml:"sectors"`
+	Bytes       interface{} `yaml:"bytes"`
+	SHA256      interface{} `yaml:"sha256"`
+}
+
+// entry checks the fields of an entry, and builds it
+func (f entryFields) entry() (entry Entry, err error) {
+	entry = Entry{
+		Source:    f.Source,
+		Partition: strings.ToLower(f.Partition),
+		Type:      f.Type,
+		Expand:    f.Expand,
+	}
+	if f.File != "" {
+		if entry.Source != "" {
+			return entry, fmt.Errorf("both source and file given")
+		}
+		entry.Source = f.File
+	}
+	if f.Format != "" {
+		if entry.Type != "" {
+			return entry, fmt.Errorf("both type and format given for %s", entry.Source)
+		}
+		entry.Type = f.Format
+	}
+	if entry.Type == "" {
+		entry.Type = "auto"
+	}
+	if entry.Source == "" {
+		return entry, fmt.Errorf("no source given")
+	}
+	if entry.Partition == "" {
+		return entry, fmt.Errorf("no partition given for %s", entry.Source)
+	}
+	if entry.Partition != NewPartition {
+		if _, err = entry.PartitionNumber(); err != nil {
+			return
+		}
+	}
+	return entry, nil
+}
+
+// Parse parses a YAML or JSON manifest. Relative source filenames are
+// taken to be relative to dir.
+func Parse(data []byte, dir string) ([]Entry, error) {
+	// A manifest is a list of entries, or a mapping with an "images"
+	// list; which one decides what to decode into
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse manifest: %v", err)
+	}
+	var list []entryFields
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var err error
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		var images struct {
+			Images []entryFields `yaml:"images"`
+
+			// Written by "export --all" about the card it read
+			Source  interface{} `yaml:"source"`
+			Created interface{} `yaml:"created"`
+		}
+		if err = decoder.Decode(&images); err == nil {
+			list = images.Images
+		}
+	} else if len(doc.Content) > 0 {
+		err = decoder.Decode(&list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("manifest lists no images")
+	}
+
+	entries := make([]Entry, len(list))
+	for i, fields := range list {
+		entry, err := fields.entry()
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %v", i+1, err)
+		}
+		if !filepath.IsAbs(entry.Source) {
+			entry.Source = filepath.Join(dir, entry.Source)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
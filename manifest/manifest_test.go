@@ -0,0 +1,105 @@
+package manifest
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"gopkg.in/d4l3k/messagediff.v1"
+)
+
+func TestParseYAML(t *testing.T) {
+	data := []byte(`# Build the games card
+---
+images:
+  - source: system.po   # boot volume
+    partition: 0
+  - source: "games #1.2mg"
+    partition: NEW
+    expand: true
+  -
+    source: /images/extra.dsk
+    partition: new
+    type: do
+`)
+	expected := []Entry{
+		{Source: filepath.Join("cards", "system.po"), Partition: "0", Type: "auto"},
+		{Source: filepath.Join("cards", "games #1.2mg"), Partition: NewPartition, Type: "auto", Expand: true},
+		{Source: "/images/extra.dsk", Partition: NewPartition, Type: "do"},
+	}
+	entries, err := Parse(data, "cards")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, entries); !equal {
+		t.Errorf("unexpected entries:\n%s", diff)
+	}
+}
+
+func TestParseTopLevelList(t *testing.T) {
+	entries, err := Parse([]byte("- source: a.po\n  partition: 2\n"), "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Source != "a.po" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if num, err := entries[0].PartitionNumber(); err != nil || num != 2 {
+		t.Errorf("partition number %d, %v", num, err)
+	}
+}
+
+func TestParseFlowYAML(t *testing.T) {
+	data := []byte(`images: [{source: 'it''s.po', partition: 1}, {source: "b.po", partition: new}]`)
+	entries, err := Parse(data, "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	expected := []Entry{
+		{Source: "it's.po", Partition: "1", Type: "auto"},
+		{Source: "b.po", Partition: NewPartition, Type: "auto"},
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, entries); !equal {
+		t.Errorf("unexpected entries:\n%s", diff)
+	}
+}
+
+func TestParseExportManifest(t *testing.T) {
+	data := []byte(`{
+	"source": "card.mdt",
+	"created": "2026-01-01T00:00:00Z",
+	"images": [
+		{"partition": 0, "file": "00-SYSTEM.po", "format": "po", "compression": "none",
+		 "volume": "SYSTEM", "start": 256, "sectors": 1600, "bytes": 819200, "sha256": "00"}
+	]
+}`)
+	entries, err := Parse(data, "backup")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	expected := []Entry{{Source: filepath.Join("backup", "00-SYSTEM.po"), Partition: "0", Type: "po"}}
+	if diff, equal := messagediff.PrettyDiff(expected, entries); !equal {
+		t.Errorf("unexpected entries:\n%s", diff)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":           "",
+		"no partition":    "- source: a.po\n",
+		"no source":       "- partition: 1\n",
+		"bad partition":   "- source: a.po\n  partition: 300\n",
+		"unknown key":     "- source: a.po\n  partition: 1\n  colour: red\n",
+		"duplicate key":   "- source: a.po\n  source: b.po\n  partition: 1\n",
+		"not a list":      "source: a.po\n",
+		"bad expand":      "- source: a.po\n  partition: 1\n  expand: maybe\n",
+		"bad json":        "[{\"source\": \"a.po\", ",
+		"json bad value":  `[{"source": "a.po", "partition": [1]}]`,
+		"source and file": "- source: a.po\n  file: b.po\n  partition: 1\n",
+	} {
+		if _, err := Parse([]byte(data), ""); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
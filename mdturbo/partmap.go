@@ -120,6 +120,25 @@ func (pt MDTurbo) GetPartition(partNum uint8) (Partition, error) {
 	return pt.Partitions2[partNum-MaxPartitions], nil
 }
 
+// Capacity returns the size of the drive in sectors, calculated from
+// its geometry. Returns 0 if the geometry isn't set.
+func (pt MDTurbo) Capacity() uint32 {
+	return uint32(pt.Cylinders) * uint32(pt.Heads) * uint32(pt.Sectors)
+}
+
+// FirstFree returns the first sector after the last partition, where
+// AddPartition will start a new one.
+func (pt MDTurbo) FirstFree() uint32 {
+	if pt.PartCount() == 0 {
+		return 256
+	}
+	last, err := pt.GetPartition(pt.PartCount() - 1)
+	if err != nil {
+		return 256
+	}
+	return last.End() + 1
+}
+
 // AddPartition adds a new partition to a disk image, returns the new
 // Partition number and an error if it can't.
 func (pt *MDTurbo) AddPartition(blocks uint32) (int, error) {
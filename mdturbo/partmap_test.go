@@ -21,6 +21,25 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestCapacity(t *testing.T) {
+	partTable, err := Deserialize(testData)
+	if err != nil {
+		t.Fatalf("could not deserialize test data: %v", err)
+	}
+	if capacity := partTable.Capacity(); capacity != 995*16*63 {
+		t.Errorf("capacity is %d sectors, expected %d", capacity, 995*16*63)
+	}
+	if free := partTable.FirstFree(); free != 459001+65535 {
+		t.Errorf("first free sector is %d, expected %d", free, 459001+65535)
+	}
+
+	var empty MDTurbo
+	if empty.Capacity() != 0 || empty.FirstFree() != 256 {
+		t.Errorf("empty table has capacity %d, first free sector %d",
+			empty.Capacity(), empty.FirstFree())
+	}
+}
+
 // TEST PARTITION DATA
 
 // Totally Standard Partition Table
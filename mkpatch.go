@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/diskimage"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/patch"
+)
+
+// MkpatchCmd makes a patch from one card image to another
+type MkpatchCmd struct {
+	Old   string `arg:"positional,required" help:"Microdrive/Turbo image the patch applies to"`
+	New   string `arg:"positional,required" help:"Microdrive/Turbo image the patch turns it into"`
+	Patch string `arg:"positional,required" help:"Patch file to write, or - for stdout"`
+	Force bool   `help:"Overwrite an existing patch file" default:"false"`
+}
+
+func makePatch(ctx context.Context) error {
+	base, baseSize, err := openSizedCard(cli.Mkpatch.Old)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	card, size, err := openSizedCard(cli.Mkpatch.New)
+	if err != nil {
+		return err
+	}
+	defer card.Close()
+	table, err := GetPartitionTable(cli.Mkpatch.New)
+	if err != nil {
+		return err
+	}
+
+	output, err := createTarget(cli.Mkpatch.Patch, cli.Mkpatch.Force)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(output)
+	p, err := patch.Make(ctx, writer, base, baseSize, card, size, table)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if cli.Mkpatch.Patch != stdioName {
+			os.Remove(cli.Mkpatch.Patch)
+		}
+		return fmt.Errorf("could not make patch: %v", err)
+	}
+	printPatch(p)
+	return nil
+}
+
+// openSizedCard opens a card image for reading, and finds its size
+func openSizedCard(filename string) (*cardImage, int64, error) {
+	card, err := openCardImage(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := diskimage.Size(card.ReaderAt)
+	if err != nil {
+		card.Close()
+		return nil, 0, fmt.Errorf("could not get the size of %s: %v", filename, err)
+	}
+	return card, size, nil
+}
+
+// printPatch reports how many blocks a patch changes in each partition
+func printPatch(p *patch.Patch) {
+	var blocks int64
+	byPartition := map[int]int64{}
+	for _, r := range p.Regions {
+		byPartition[r.Partition] += r.Length / mdturbo.SectorSize
+		blocks += r.Length / mdturbo.SectorSize
+	}
+	fmt.Fprintf(os.Stderr, "Patch changes %d blocks in %d regions\n", blocks, len(p.Regions))
+	if count, ok := byPartition[-1]; ok {
+		fmt.Fprintf(os.Stderr, "Partition table and unpartitioned space: %d blocks\n", count)
+	}
+	for num := 0; num < 2*mdturbo.MaxPartitions; num++ {
+		if count, ok := byPartition[num]; ok {
+			fmt.Fprintf(os.Stderr, "Partition %d: %d blocks\n", num, count)
+		}
+	}
+}
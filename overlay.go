@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+)
+
+// overlayBlockSize is the granularity at which an overlay holds changes
+const overlayBlockSize = 512
+
+// overlay is a writable view of read-only data. Writes are kept in
+// memory, block by block, and never reach the underlying data.
+type overlay struct {
+	base   io.ReaderAt
+	length int64
+	blocks map[int64][]byte // Changed blocks, by block number
+}
+
+// newOverlay returns an overlay over the first length bytes of base
+func newOverlay(base io.ReaderAt, length int64) *overlay {
+	return &overlay{base: base, length: length, blocks: make(map[int64][]byte)}
+}
+
+// ReadAt reads through to the underlying data, except where it has
+// been overwritten
+func (o *overlay) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= o.length {
+			return n, io.EOF
+		}
+		within := pos % overlayBlockSize
+		chunk := int64(overlayBlockSize) - within
+		if rest := int64(len(p) - n); rest < chunk {
+			chunk = rest
+		}
+		if rest := o.length - pos; rest < chunk {
+			chunk = rest
+		}
+		var read int
+		if block := o.blocks[pos/overlayBlockSize]; block != nil {
+			read = copy(p[n:n+int(chunk)], block[within:])
+		} else {
+			read, err = o.base.ReadAt(p[n:n+int(chunk)], pos)
+		}
+		n += read
+		if err != nil && !(err == io.EOF && read == int(chunk)) {
+			return n, err
+		}
+		err = nil
+	}
+	return n, nil
+}
+
+// WriteAt records changed data in memory
+func (o *overlay) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= o.length {
+			return n, io.ErrShortWrite
+		}
+		blockNum := pos / overlayBlockSize
+		block := o.blocks[blockNum]
+		if block == nil {
+			block = make([]byte, overlayBlockSize)
+			if _, err = o.ReadAt(block, blockNum*overlayBlockSize); err != nil && err != io.EOF {
+				return n, err
+			}
+			o.blocks[blockNum] = block
+		}
+		n += copy(block[pos%overlayBlockSize:], p[n:])
+	}
+	return n, nil
+}
+
+// Size returns the length of the data
+func (o *overlay) Size() int64 {
+	return o.length
+}
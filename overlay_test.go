@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	base := streamData(8 * overlayBlockSize)
+	original := append([]byte(nil), base...)
+	o := newOverlay(bytes.NewReader(base), int64(len(base)))
+
+	// Change part of block 2, and the end of block 4 into block 5
+	expected := append([]byte(nil), base...)
+	for _, w := range []struct {
+		off  int64
+		data []byte
+	}{
+		{2*overlayBlockSize + 100, bytes.Repeat([]byte{0xaa}, 50)},
+		{5*overlayBlockSize - 10, bytes.Repeat([]byte{0xbb}, 20)},
+	} {
+		if wrote, err := o.WriteAt(w.data, w.off); err != nil || wrote != len(w.data) {
+			t.Fatalf("write at %d returned %d bytes, %v", w.off, wrote, err)
+		}
+		copy(expected[w.off:], w.data)
+	}
+	if !bytes.Equal(base, original) {
+		t.Errorf("writes reached the underlying data")
+	}
+	if len(o.blocks) != 3 {
+		t.Errorf("overlay holds %d blocks, expected 3", len(o.blocks))
+	}
+
+	// Reads spanning written and unwritten blocks, at odd offsets
+	for _, r := range []struct {
+		off    int64
+		length int
+	}{
+		{0, len(expected)},
+		{overlayBlockSize + 7, 3 * overlayBlockSize},
+		{2*overlayBlockSize + 120, 10},
+		{4*overlayBlockSize + 500, 40},
+		{5*overlayBlockSize + 1, overlayBlockSize},
+	} {
+		buf := make([]byte, r.length)
+		read, err := o.ReadAt(buf, r.off)
+		if err != nil || read != r.length {
+			t.Errorf("read of %d bytes at %d returned %d bytes, %v", r.length, r.off, read, err)
+			continue
+		}
+		if !bytes.Equal(buf, expected[r.off:r.off+int64(r.length)]) {
+			t.Errorf("read of %d bytes at %d returned the wrong data", r.length, r.off)
+		}
+	}
+
+	// Reads and writes stop at the end
+	buf := make([]byte, 2*overlayBlockSize)
+	read, err := o.ReadAt(buf, int64(len(expected))-overlayBlockSize)
+	if err != io.EOF || read != overlayBlockSize || !bytes.Equal(buf[:read], expected[len(expected)-overlayBlockSize:]) {
+		t.Errorf("read across the end returned %d bytes, %v; expected %d and EOF", read, err, overlayBlockSize)
+	}
+	if wrote, err := o.WriteAt(buf, int64(len(expected))-10); err != io.ErrShortWrite || wrote != 10 {
+		t.Errorf("write across the end returned %d bytes, %v; expected 10 and a short write", wrote, err)
+	}
+}
+
+func TestOverlayShortBase(t *testing.T) {
+	// Only the first length bytes of the base are seen
+	base := streamData(4 * overlayBlockSize)
+	o := newOverlay(bytes.NewReader(base), 3*overlayBlockSize-100)
+	if o.Size() != 3*overlayBlockSize-100 {
+		t.Errorf("overlay size is %d", o.Size())
+	}
+	if _, err := o.WriteAt([]byte{1, 2, 3}, 2*overlayBlockSize); err != nil {
+		t.Fatalf("write into the last partial block failed: %v", err)
+	}
+	buf := make([]byte, overlayBlockSize)
+	read, err := o.ReadAt(buf, 2*overlayBlockSize)
+	if err != io.EOF || read != overlayBlockSize-100 {
+		t.Errorf("read of the last block returned %d bytes, %v", read, err)
+	}
+	if !bytes.Equal(buf[:3], []byte{1, 2, 3}) || !bytes.Equal(buf[3:read], base[2*overlayBlockSize+3:3*overlayBlockSize-100]) {
+		t.Errorf("read of the last block returned the wrong data")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// partitionDevice reads and writes one partition of a card image, with
+// offsets relative to the start of the partition
+type partitionDevice struct {
+	card   cardDevice
+	start  int64 // Start of the partition, in bytes
+	length int64 // Length of the partition, in bytes
+}
+
+// cardDevice is a card image that can be read and written
+type cardDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// newPartitionDevice returns a device for a partition of card
+func newPartitionDevice(card cardDevice, partition mdturbo.Partition) partitionDevice {
+	return partitionDevice{
+		card:   card,
+		start:  int64(partition.Start) * mdturbo.SectorSize,
+		length: int64(partition.Length()) * mdturbo.SectorSize,
+	}
+}
+
+// ReadAt reads from the partition, returning io.EOF at its end
+func (p partitionDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off >= p.length {
+		return 0, io.EOF
+	}
+	if rest := p.length - off; int64(len(b)) > rest {
+		read, err := p.card.ReadAt(b[:rest], p.start+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return read, err
+	}
+	return p.card.ReadAt(b, p.start+off)
+}
+
+// WriteAt writes to the partition, refusing to write past its end
+func (p partitionDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.length {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the partition", len(b), off)
+	}
+	return p.card.WriteAt(b, p.start+off)
+}
+
+// Size returns the length of the partition
+func (p partitionDevice) Size() int64 {
+	return p.length
+}
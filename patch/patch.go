@@ -0,0 +1,307 @@
+// Package patch makes and applies binary patches between two
+// Microdrive/Turbo card images, so an update to a card can be shared
+// without sharing the whole card.
+//
+// A patch lists the regions of the card that changed, each split at
+// partition boundaries and tagged with the partition holding it, along
+// with a checksum of what the original card held there, so a patch is
+// never applied to the wrong card. Like an undo journal, a patch is a
+// single line of JSON describing it, followed by the new data of each
+// region, in order.
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/transfer"
+)
+
+// Format identifies a patch file
+const Format = "mdpatch"
+
+// Version is the version of the patch format written
+const Version = 1
+
+// blockSize is the unit in which cards are compared
+const blockSize = mdturbo.SectorSize
+
+// readSize is how much of each card is read at a time
+const readSize = 64 * 1024
+
+// Region is a range of the card changed by a patch
+type Region struct {
+	Partition int    `json:"partition"` // Partition in the new table, or -1 for none, as for the table itself
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Original  string `json:"original"` // SHA-256 of what the base card holds here, as far as it goes
+	Patched   string `json:"patched"`  // SHA-256 of the new data
+}
+
+// Patch describes the changes from a base card to a new one
+type Patch struct {
+	Format    string   `json:"format"`
+	Version   int      `json:"version"`
+	BaseSize  int64    `json:"baseSize"`  // Size of the base card
+	Size      int64    `json:"size"`      // Size of the new card
+	BaseTable string   `json:"baseTable"` // SHA-256 of the base card's partition table
+	Regions   []Region `json:"regions"`
+
+	file io.ReaderAt // Patch file read by Open
+	data int64       // Offset of the region data in the file
+}
+
+// hashOf returns the hex SHA-256 of some data
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashRange returns the hex SHA-256 of a range of a card, cut short at
+// size
+func hashRange(card io.ReaderAt, offset, length, size int64) (string, error) {
+	if offset+length > size {
+		length = size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(card, offset, length)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Make compares a base card of baseSize bytes with a new card of size
+// bytes, whose partition table is table, and writes a patch from one to
+// the other to w. Stops between reads if ctx is cancelled.
+func Make(ctx context.Context, w io.Writer, base io.ReaderAt, baseSize int64, card io.ReaderAt, size int64, table mdturbo.MDTurbo) (p *Patch, err error) {
+	p = &Patch{Format: Format, Version: Version, BaseSize: baseSize, Size: size}
+	if p.BaseTable, err = hashRange(base, 0, mdturbo.PartitionBlkLen, baseSize); err != nil {
+		return nil, err
+	}
+	if p.Regions, err = changedRegions(ctx, base, baseSize, card, size, table); err != nil {
+		return nil, err
+	}
+	for i := range p.Regions {
+		r := &p.Regions[i]
+		if r.Original, err = hashRange(base, r.Offset, r.Length, baseSize); err != nil {
+			return nil, err
+		}
+		if r.Patched, err = hashRange(card, r.Offset, r.Length, size); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append(header, '\n')); err != nil {
+		return nil, err
+	}
+	for _, r := range p.Regions {
+		if _, err = io.Copy(w, io.NewSectionReader(card, r.Offset, r.Length)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// partitionOf returns the partition in table holding a block, or -1
+func partitionOf(table mdturbo.MDTurbo, block int64) int {
+	for num := uint8(0); num < table.PartCount(); num++ {
+		partition, err := table.GetPartition(num)
+		if err != nil {
+			break
+		}
+		if block >= int64(partition.Start) && block < int64(partition.Start)+int64(partition.Length()) {
+			return int(num)
+		}
+	}
+	return -1
+}
+
+// changedRegions finds the blocks of a card that differ from the base,
+// and merges them into regions that don't cross partition boundaries
+func changedRegions(ctx context.Context, base io.ReaderAt, baseSize int64, card io.ReaderAt, size int64, table mdturbo.MDTurbo) (regions []Region, err error) {
+	newData := make([]byte, readSize)
+	oldData := make([]byte, readSize)
+	for offset := int64(0); offset < size; offset += readSize {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk := newData
+		if rest := size - offset; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		if read, err := card.ReadAt(chunk, offset); read != len(chunk) {
+			return nil, fmt.Errorf("could not read new card at %d: %v", offset, err)
+		}
+		oldRead, err := base.ReadAt(oldData[:len(chunk)], offset)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not read base card at %d: %v", offset, err)
+		}
+		for start := 0; start < len(chunk); start += blockSize {
+			end := start + blockSize
+			if end > len(chunk) {
+				end = len(chunk)
+			}
+			if end <= oldRead && bytes.Equal(chunk[start:end], oldData[start:end]) {
+				continue
+			}
+			block := (offset + int64(start)) / blockSize
+			partition := partitionOf(table, block)
+			if n := len(regions); n > 0 && regions[n-1].Partition == partition &&
+				regions[n-1].Offset+regions[n-1].Length == offset+int64(start) {
+				regions[n-1].Length += int64(end - start)
+				continue
+			}
+			regions = append(regions, Region{
+				Partition: partition,
+				Offset:    offset + int64(start),
+				Length:    int64(end - start),
+			})
+		}
+	}
+	return regions, nil
+}
+
+// Open reads the description of a patch from a patch file
+func Open(file io.ReaderAt) (*Patch, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("not a patch file: %v", err)
+	}
+	var p Patch
+	if err = json.Unmarshal(line, &p); err != nil || p.Format != Format {
+		return nil, fmt.Errorf("not a patch file")
+	}
+	if p.Version > Version {
+		return nil, fmt.Errorf("patch is version %d; only up to %d is supported", p.Version, Version)
+	}
+	p.file, p.data = file, int64(len(line))
+	return &p, nil
+}
+
+// regionData returns a reader for the new data of each region
+func (p *Patch) regionData() []*io.SectionReader {
+	sections := make([]*io.SectionReader, len(p.Regions))
+	offset := p.data
+	for i, r := range p.Regions {
+		sections[i] = io.NewSectionReader(p.file, offset, r.Length)
+		offset += r.Length
+	}
+	return sections
+}
+
+// Verify checks the data in a patch file against its checksums
+func (p *Patch) Verify() error {
+	for i, section := range p.regionData() {
+		r := p.Regions[i]
+		hash, err := hashRange(section, 0, r.Length, r.Length)
+		if err != nil {
+			return fmt.Errorf("patch is damaged: %v", err)
+		}
+		if hash != r.Patched {
+			return fmt.Errorf("patch is damaged: data for bytes %d-%d doesn't match its checksum",
+				r.Offset, r.Offset+r.Length-1)
+		}
+	}
+	return nil
+}
+
+// Check makes sure a card of size bytes is the base the patch was made
+// from: it must be at least as large, and hold the same partition table
+// and the same data in every region the patch changes
+func (p *Patch) Check(card io.ReaderAt, size int64) error {
+	if size < p.BaseSize {
+		return fmt.Errorf("card is %d bytes; the patch is for a card of %d bytes", size, p.BaseSize)
+	}
+	if hash, err := hashRange(card, 0, mdturbo.PartitionBlkLen, p.BaseSize); err != nil || hash != p.BaseTable {
+		return fmt.Errorf("card's partition table isn't the one the patch was made from")
+	}
+	for _, r := range p.Regions {
+		hash, err := hashRange(card, r.Offset, r.Length, p.BaseSize)
+		if err != nil {
+			return err
+		}
+		if hash != r.Original {
+			return fmt.Errorf("card differs from the patch's base at bytes %d-%d%s",
+				r.Offset, r.Offset+r.Length-1, r.where())
+		}
+	}
+	return nil
+}
+
+// where describes the partition holding a region, for messages
+func (r Region) where() string {
+	if r.Partition < 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (partition %d)", r.Partition)
+}
+
+// Apply writes the new data of each region to a card, stopping if ctx
+// is cancelled. The partition table is written last, once everything
+// else is flushed, so it never describes data that isn't there yet.
+// Returns the number of bytes written. Check and Verify should be used
+// first.
+func (p *Patch) Apply(ctx context.Context, card transfer.Card) (written int64, err error) {
+	var table *mdturbo.MDTurbo
+	for i, section := range p.regionData() {
+		r := p.Regions[i]
+		if r.Offset == 0 && r.Length >= mdturbo.PartitionBlkLen {
+			var sector [mdturbo.PartitionBlkLen]byte
+			if _, err = io.ReadFull(section, sector[:]); err != nil {
+				return written, fmt.Errorf("could not read patch: %v", err)
+			}
+			parsed, err := mdturbo.Deserialize(sector)
+			if err != nil {
+				return written, err
+			}
+			table = &parsed
+			r.Offset += mdturbo.PartitionBlkLen
+			r.Length -= mdturbo.PartitionBlkLen
+		}
+		wrote, err := transfer.CopyAt(ctx, card, r.Offset, section, r.Length)
+		written += wrote
+		if err != nil {
+			return written, err
+		}
+	}
+	if table != nil {
+		if err = transfer.WriteTable(card, *table); err != nil {
+			return written, err
+		}
+		written += mdturbo.PartitionBlkLen
+	}
+	return written, nil
+}
+
+// Data returns the new data of the region at offset, or nil if there's
+// no region starting there
+func (p *Patch) Data(offset int64) ([]byte, error) {
+	for i, section := range p.regionData() {
+		if p.Regions[i].Offset != offset {
+			continue
+		}
+		data := make([]byte, p.Regions[i].Length)
+		if _, err := io.ReadFull(section, data); err != nil {
+			return nil, fmt.Errorf("could not read patch: %v", err)
+		}
+		return data, nil
+	}
+	return nil, nil
+}
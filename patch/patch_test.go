@@ -0,0 +1,172 @@
+package patch
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// memCard is an in-memory card that grows as it's written
+type memCard struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newCard(data []byte) *memCard {
+	return &memCard{bytes.NewReader(data), data}
+}
+
+func (m *memCard) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	copy(m.data[off:], p)
+	m.Reader = bytes.NewReader(m.data)
+	return len(p), nil
+}
+
+// cards returns a base card and a changed copy of it, with the table
+// of the changed one
+func cards() (base, changed []byte, table mdturbo.MDTurbo) {
+	table = mdturbo.MDTurbo{Magic: 52426}
+	table.AddPartition(8)
+	table.AddPartition(8)
+	base = make([]byte, 272*mdturbo.SectorSize)
+	sector, _ := table.Serialize()
+	copy(base, sector[:])
+
+	changed = append([]byte(nil), base...)
+	changed[263*mdturbo.SectorSize] = 1 // Last block of partition 0
+	changed[264*mdturbo.SectorSize] = 2 // First of partition 1
+	changed = append(changed, make([]byte, mdturbo.SectorSize)...)
+	changed[len(changed)-1] = 3 // Past the end of the base
+	return base, changed, table
+}
+
+func TestPatch(t *testing.T) {
+	base, changed, table := cards()
+	var file bytes.Buffer
+	made, err := Make(context.Background(), &file, bytes.NewReader(base), int64(len(base)),
+		bytes.NewReader(changed), int64(len(changed)), table)
+	if err != nil {
+		t.Fatalf("could not make patch: %v", err)
+	}
+	if len(made.Regions) != 3 || made.Regions[0].Partition != 0 || made.Regions[1].Partition != 1 ||
+		made.Regions[2].Partition != -1 {
+		t.Fatalf("patch has regions %+v", made.Regions)
+	}
+	if made.Regions[0].Length != mdturbo.SectorSize {
+		t.Errorf("region of one changed block is %d bytes", made.Regions[0].Length)
+	}
+
+	p, err := Open(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("could not open patch: %v", err)
+	}
+	if err = p.Verify(); err != nil {
+		t.Errorf("patch didn't verify: %v", err)
+	}
+	card := newCard(append([]byte(nil), base...))
+	if err = p.Check(card, int64(len(base))); err != nil {
+		t.Fatalf("base card didn't check: %v", err)
+	}
+	if _, err = p.Apply(context.Background(), card); err != nil {
+		t.Fatalf("could not apply patch: %v", err)
+	}
+	if !bytes.Equal(card.data, changed) {
+		t.Errorf("patched card doesn't match the new card")
+	}
+}
+
+func TestPatchMismatch(t *testing.T) {
+	base, changed, table := cards()
+	var file bytes.Buffer
+	if _, err := Make(context.Background(), &file, bytes.NewReader(base), int64(len(base)),
+		bytes.NewReader(changed), int64(len(changed)), table); err != nil {
+		t.Fatalf("could not make patch: %v", err)
+	}
+	p, err := Open(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("could not open patch: %v", err)
+	}
+
+	other := append([]byte(nil), base...)
+	other[264*mdturbo.SectorSize+10] = 9
+	if err = p.Check(bytes.NewReader(other), int64(len(other))); err == nil {
+		t.Errorf("card with different data checked as the base")
+	}
+	other = append([]byte(nil), base...)
+	other[2] = 1
+	if err = p.Check(bytes.NewReader(other), int64(len(other))); err == nil {
+		t.Errorf("card with a different table checked as the base")
+	}
+	if err = p.Check(bytes.NewReader(base), 1024); err == nil {
+		t.Errorf("smaller card checked as the base")
+	}
+
+	damaged := file.Bytes()
+	damaged[len(damaged)-1] ^= 0xff
+	if p, err = Open(bytes.NewReader(damaged)); err != nil {
+		t.Fatalf("could not open patch: %v", err)
+	}
+	if err = p.Verify(); err == nil {
+		t.Errorf("damaged patch verified")
+	}
+	if _, err = Open(bytes.NewReader([]byte("{}\n"))); err == nil {
+		t.Errorf("non-patch opened as a patch")
+	}
+}
+
+// orderCard is a card that records the offset of each write
+type orderCard struct {
+	*memCard
+	writes []int64
+}
+
+func (o *orderCard) WriteAt(p []byte, off int64) (int, error) {
+	o.writes = append(o.writes, off)
+	return o.memCard.WriteAt(p, off)
+}
+
+func TestPatchTableLast(t *testing.T) {
+	base, changed, table := cards()
+	table.AddPartition(8)
+	sector, _ := table.Serialize()
+	copy(changed, sector[:])
+	changed[mdturbo.PartitionBlkLen] = 4 // Same region as the table
+	var file bytes.Buffer
+	if _, err := Make(context.Background(), &file, bytes.NewReader(base), int64(len(base)),
+		bytes.NewReader(changed), int64(len(changed)), table); err != nil {
+		t.Fatalf("could not make patch: %v", err)
+	}
+	p, err := Open(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("could not open patch: %v", err)
+	}
+	if p.Regions[0].Offset != 0 || p.Regions[0].Length != 2*mdturbo.SectorSize {
+		t.Fatalf("patch has regions %+v", p.Regions)
+	}
+
+	card := &orderCard{memCard: newCard(append([]byte(nil), base...))}
+	written, err := p.Apply(context.Background(), card)
+	if err != nil {
+		t.Fatalf("could not apply patch: %v", err)
+	}
+	if !bytes.Equal(card.data, changed) {
+		t.Errorf("patched card doesn't match the new card")
+	}
+	var total int64
+	for _, r := range p.Regions {
+		total += r.Length
+	}
+	if written != total {
+		t.Errorf("patch wrote %d bytes", written)
+	}
+	if last := card.writes[len(card.writes)-1]; last != 0 {
+		t.Errorf("last write was at %d, not the partition table", last)
+	}
+}
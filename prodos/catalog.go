@@ -0,0 +1,194 @@
+package prodos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// More directory entry fields, relative to the start of an entry
+const (
+	offEntryType    = 0x10
+	offEntryEOF     = 0x15
+	offEntryAuxType = 0x1f
+	offEntryModDate = 0x21
+
+	typeDirectory = 0x0f
+)
+
+// typeNames are the usual abbreviations of common file types
+var typeNames = map[byte]string{
+	0x00: "NON", 0x01: "BAD", 0x04: "TXT", 0x06: "BIN", 0x0f: "DIR",
+	0x19: "ADB", 0x1a: "AWP", 0x1b: "ASP", 0xb3: "S16", 0xef: "PAS",
+	0xf0: "CMD", 0xfa: "INT", 0xfb: "IVR", 0xfc: "BAS", 0xfd: "VAR",
+	0xfe: "REL", 0xff: "SYS",
+}
+
+// TypeName returns the abbreviation for a file type, such as TXT, or
+// its number in hex if it has none
+func TypeName(fileType byte) string {
+	if name, ok := typeNames[fileType]; ok {
+		return name
+	}
+	return fmt.Sprintf("$%02X", fileType)
+}
+
+// File is a file or directory in a volume's catalog
+type File struct {
+	Path     string    `json:"path"`     // Such as /GAMES/ZORK1
+	Type     byte      `json:"type"`     // ProDOS file type
+	AuxType  uint16    `json:"auxType"`  // Load address, record length, and so on
+	Size     int64     `json:"size"`     // Length of the data, in bytes
+	Blocks   int       `json:"blocks"`   // Blocks used, including index blocks
+	Modified time.Time `json:"modified"` // Zero if not set
+
+	storage byte
+	key     int
+
+	// The data fork: for an extended file, as found in its key block,
+	// and otherwise the file itself
+	dataStorage byte
+	dataKey     int
+}
+
+// IsDir returns true if the file is a directory
+func (f File) IsDir() bool {
+	return f.storage == storageSubdir
+}
+
+// Catalog returns every file and directory on a volume, each directory
+// before its contents
+func Catalog(r io.ReaderAt) ([]File, error) {
+	vol, err := ReadVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	walk(r, VolumeDirBlock, "/"+vol.Name, nil, func(f File) {
+		files = append(files, f)
+	})
+	return files, nil
+}
+
+// parseEntry reads a directory entry in the directory dir, returning
+// false if it's deleted. An extended file's size is that of its data
+// fork, read from its key block.
+func parseEntry(r io.ReaderAt, e []byte, dir string) (f File, ok bool) {
+	storage, nameLen := e[0]>>4, int(e[0]&0x0f)
+	if storage == 0 || nameLen == 0 {
+		return f, false
+	}
+	f = File{
+		Path:     dir + "/" + string(e[1:1+nameLen]),
+		Type:     e[offEntryType],
+		AuxType:  binary.LittleEndian.Uint16(e[offEntryAuxType:]),
+		Size:     eof(e[offEntryEOF:]),
+		Blocks:   int(binary.LittleEndian.Uint16(e[offEntryUsed:])),
+		Modified: dateTime(e[offEntryModDate:]),
+		storage:  storage,
+		key:      int(binary.LittleEndian.Uint16(e[offEntryKey:])),
+	}
+	f.dataStorage, f.dataKey = f.storage, f.key
+	if storage == storageExtended {
+		// An unreadable key block leaves no data fork to read
+		f.dataStorage, f.dataKey = 0, 0
+		if block, err := readBlock(r, f.key); err == nil {
+			fork := block[offDataFork:]
+			f.dataStorage = fork[0] & 0x0f
+			f.dataKey = int(binary.LittleEndian.Uint16(fork[offForkKey:]))
+			f.Size = eof(fork[offForkEOF:])
+		}
+	}
+	return f, true
+}
+
+// eof reads a three byte file length
+func eof(b []byte) int64 {
+	return int64(b[0]) | int64(b[1])<<8 | int64(b[2])<<16
+}
+
+// dateTime decodes a ProDOS date and time. Years 40 to 99 are 1940 to
+// 1999, and 0 to 39 are 2000 to 2039, as ProDOS 2.4 has it.
+func dateTime(b []byte) time.Time {
+	date := binary.LittleEndian.Uint16(b)
+	if date == 0 {
+		return time.Time{}
+	}
+	year := int(date >> 9)
+	if year < 40 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	month := time.Month(date >> 5 & 0x0f)
+	day := int(date & 0x1f)
+	return time.Date(year, month, day, int(b[3]&0x1f), int(b[2]&0x3f), 0, 0, time.UTC)
+}
+
+// ReadFile returns the contents of a file's data fork. Sparse blocks
+// read as zeroes.
+func ReadFile(r io.ReaderAt, f File) ([]byte, error) {
+	storage, key, size := f.dataStorage, f.dataKey, f.Size
+	switch f.storage {
+	case storageSubdir:
+		return nil, fmt.Errorf("%s is a directory", f.Path)
+	case storagePascal:
+		return nil, fmt.Errorf("%s is a Pascal area", f.Path)
+	}
+
+	data := make([]byte, 0, size)
+	var index []byte
+	indexNum := -1
+	for i := 0; int64(len(data)) < size; i++ {
+		block := 0
+		switch storage {
+		case storageSeedling:
+			if i == 0 {
+				block = key
+			}
+		case storageSapling:
+			if index == nil {
+				var err error
+				if index, err = readBlock(r, key); err != nil {
+					return nil, err
+				}
+			}
+			if i < BlockSize/2 {
+				block = pointer(index, i)
+			}
+		case storageTree:
+			if indexNum != i/(BlockSize/2) {
+				indexNum = i / (BlockSize / 2)
+				master, err := readBlock(r, key)
+				if err != nil {
+					return nil, err
+				}
+				index = make([]byte, BlockSize)
+				if indexNum < BlockSize/2 {
+					if sub := pointer(master, indexNum); sub != 0 {
+						if index, err = readBlock(r, sub); err != nil {
+							return nil, err
+						}
+					}
+				}
+			}
+			block = pointer(index, i%(BlockSize/2))
+		default:
+			return nil, fmt.Errorf("%s has unknown storage type %d", f.Path, storage)
+		}
+
+		chunk := make([]byte, BlockSize)
+		if block != 0 {
+			var err error
+			if chunk, err = readBlock(r, block); err != nil {
+				return nil, err
+			}
+		}
+		if rest := size - int64(len(data)); rest < BlockSize {
+			chunk = chunk[:rest]
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
@@ -0,0 +1,178 @@
+package prodos
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Directory entry layout, relative to the start of an entry
+const (
+	offEntryKey  = 0x11
+	offEntryUsed = 0x13
+
+	dirEntriesStart = 0x04 // Entries follow the prev and next pointers
+	offDirNext      = 0x02
+
+	storageSeedling = 0x1
+	storageSapling  = 0x2
+	storageTree     = 0x3
+	storagePascal   = 0x4
+	storageExtended = 0x5
+	storageSubdir   = 0xd
+
+	// Fork entries in an extended key block: storage type, key block,
+	// blocks used, then a three byte EOF
+	offDataFork     = 0x000
+	offResourceFork = 0x100
+	offForkKey      = 0x01
+	offForkEOF      = 0x05
+)
+
+// walk calls visit with every entry in a directory, starting at its
+// key block, and in every directory below it, each directory before its
+// contents. Before each directory block is read, dirBlock, if given, is
+// called with it and the directory's path, and may return false to stop
+// following that directory. No block is read twice, so a damaged volume
+// can't send the walk round in circles.
+func walk(r io.ReaderAt, key int, path string, dirBlock func(block int, path string) bool, visit func(File)) {
+	seen := make(map[int]bool)
+	var directory func(key int, path string)
+	directory = func(key int, path string) {
+		for block, first := key, true; block != 0 && !seen[block]; first = false {
+			seen[block] = true
+			if dirBlock != nil && !dirBlock(block, path) {
+				return
+			}
+			data, err := readBlock(r, block)
+			if err != nil {
+				return
+			}
+			for i := 0; i < entriesPer; i++ {
+				if first && i == 0 {
+					continue // The directory's own header
+				}
+				start := dirEntriesStart + i*entryLength
+				if f, ok := parseEntry(r, data[start:start+entryLength], path); ok {
+					visit(f)
+					if f.IsDir() {
+						directory(f.key, f.Path)
+					}
+				}
+			}
+			block = int(binary.LittleEndian.Uint16(data[offDirNext:]))
+		}
+	}
+	directory(key, path)
+}
+
+// Owners returns what each block of a volume holds: the path of the
+// file or directory using it, such as /GAMES/ZORK1, or the name of a
+// volume structure such as "volume bitmap". Blocks nothing uses are "".
+// A damaged directory is followed only as far as it makes sense.
+func Owners(r io.ReaderAt) ([]string, error) {
+	vol, err := ReadVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	w := &claims{r: r, owners: make([]string, vol.TotalBlocks)}
+	w.claim(0, "boot blocks")
+	w.claim(1, "boot blocks")
+	for i := 0; i < vol.BitmapBlocks(); i++ {
+		w.claim(int(vol.BitmapStart)+i, "volume bitmap")
+	}
+	root := "/" + vol.Name
+	walk(r, VolumeDirBlock, root, func(block int, path string) bool {
+		if path == root {
+			return w.claim(block, "volume directory")
+		}
+		return w.claim(block, path)
+	}, w.entry)
+	return w.owners, nil
+}
+
+// claims records who owns each block of a volume
+type claims struct {
+	r      io.ReaderAt
+	owners []string
+}
+
+// claim records the owner of a block. Returns false if the block is
+// outside the volume or already owned, as only a damaged volume has it.
+func (w *claims) claim(block int, owner string) bool {
+	if block < 0 || block >= len(w.owners) || w.owners[block] != "" {
+		return false
+	}
+	w.owners[block] = owner
+	return true
+}
+
+// pointer reads entry i of an index block, whose low bytes are in its
+// first half and high bytes in its second
+func pointer(index []byte, i int) int {
+	return int(index[i]) | int(index[i+BlockSize/2])<<8
+}
+
+// entry claims the blocks of a file. A directory's blocks are claimed
+// as the walk reads them.
+func (w *claims) entry(f File) {
+	switch f.storage {
+	case storageSubdir:
+	case storagePascal:
+		for block := f.key; block < f.key+f.Blocks; block++ {
+			w.claim(block, f.Path)
+		}
+	case storageExtended:
+		if !w.claim(f.key, f.Path) {
+			return
+		}
+		w.fork(f.dataStorage, f.dataKey, f.Path)
+		data, err := readBlock(w.r, f.key)
+		if err != nil {
+			return
+		}
+		fork := data[offResourceFork:]
+		w.fork(fork[0]&0x0f, int(binary.LittleEndian.Uint16(fork[offForkKey:])), f.Path+" (resource fork)")
+	default:
+		w.fork(f.storage, f.key, f.Path)
+	}
+}
+
+// fork claims the blocks of a file's data, held as a seedling, sapling
+// or tree
+func (w *claims) fork(storage byte, key int, path string) {
+	switch storage {
+	case storageSeedling:
+		w.claim(key, path)
+	case storageSapling:
+		w.index(key, path)
+	case storageTree:
+		if !w.claim(key, path) {
+			return
+		}
+		master, err := readBlock(w.r, key)
+		if err != nil {
+			return
+		}
+		for i := 0; i < BlockSize/2; i++ {
+			if block := pointer(master, i); block != 0 {
+				w.index(block, path)
+			}
+		}
+	}
+}
+
+// index claims an index block and the data blocks it points to
+func (w *claims) index(block int, path string) {
+	if !w.claim(block, path) {
+		return
+	}
+	index, err := readBlock(w.r, block)
+	if err != nil {
+		return
+	}
+	for i := 0; i < BlockSize/2; i++ {
+		if data := pointer(index, i); data != 0 {
+			w.claim(data, path)
+		}
+	}
+}
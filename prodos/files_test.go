@@ -0,0 +1,147 @@
+package prodos
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// addEntry writes a directory entry into slot i of a directory block
+func addEntry(d memDevice, dirBlock, i int, storage byte, name string, key, used int) {
+	e := d[dirBlock*BlockSize+dirEntriesStart+i*entryLength:]
+	e[0] = storage<<4 | byte(len(name))
+	copy(e[1:], name)
+	binary.LittleEndian.PutUint16(e[offEntryKey:], uint16(key))
+	binary.LittleEndian.PutUint16(e[offEntryUsed:], uint16(used))
+}
+
+// setPointer writes entry i of an index block
+func setPointer(d memDevice, index, i, block int) {
+	d[index*BlockSize+i] = byte(block)
+	d[index*BlockSize+i+BlockSize/2] = byte(block >> 8)
+}
+
+func TestOwners(t *testing.T) {
+	d := newVolume("OWN", 280, 280)
+	addEntry(d, VolumeDirBlock, 1, storageSeedling, "SEED", 20, 1)
+	addEntry(d, VolumeDirBlock, 2, storageSapling, "SAP", 30, 3)
+	setPointer(d, 30, 0, 31)
+	setPointer(d, 30, 2, 32) // Sparse block 1
+	addEntry(d, VolumeDirBlock, 3, storageSubdir, "DIR", 40, 1)
+	addEntry(d, 40, 1, storageSeedling, "INNER", 41, 1)
+	addEntry(d, VolumeDirBlock, 4, storageSeedling, "LOOP", VolumeDirBlock, 1)
+
+	owners, err := Owners(d)
+	if err != nil {
+		t.Fatalf("could not read owners: %v", err)
+	}
+	expected := map[int]string{
+		0:               "boot blocks",
+		VolumeDirBlock:  "volume directory",
+		testBitmapStart: "volume bitmap",
+		20:              "/OWN/SEED",
+		30:              "/OWN/SAP",
+		31:              "/OWN/SAP",
+		32:              "/OWN/SAP",
+		40:              "/OWN/DIR",
+		41:              "/OWN/DIR/INNER",
+		50:              "",
+	}
+	for block, owner := range expected {
+		if owners[block] != owner {
+			t.Errorf("block %d owned by %q, expected %q", block, owners[block], owner)
+		}
+	}
+}
+
+// setFile sets the size, type and modification date of the file in
+// slot i of a directory block
+func setFile(d memDevice, dirBlock, i int, fileType byte, size int, modified uint32) {
+	e := d[dirBlock*BlockSize+dirEntriesStart+i*entryLength:]
+	e[offEntryType] = fileType
+	e[offEntryEOF], e[offEntryEOF+1], e[offEntryEOF+2] = byte(size), byte(size>>8), byte(size>>16)
+	binary.LittleEndian.PutUint32(e[offEntryModDate:], modified)
+}
+
+func TestCatalog(t *testing.T) {
+	d := newVolume("CAT", 280, 280)
+	addEntry(d, VolumeDirBlock, 1, storageSapling, "SAP", 30, 3)
+	// 3 December 1987 at 13:45: year 87, month 12, day 3
+	setFile(d, VolumeDirBlock, 1, 0x06, 1100, uint32(87<<9|12<<5|3)|45<<16|13<<24)
+	setPointer(d, 30, 0, 31)
+	setPointer(d, 30, 2, 32) // Block 1 is sparse
+	d[31*BlockSize] = 'A'
+	d[32*BlockSize] = 'C'
+	addEntry(d, VolumeDirBlock, 2, storageSubdir, "DIR", 40, 1)
+	setFile(d, VolumeDirBlock, 2, typeDirectory, BlockSize, 0)
+	addEntry(d, 40, 1, storageSeedling, "NOTE", 41, 1)
+	setFile(d, 40, 1, 0x04, 5, uint32(5<<9|1<<5|2))
+	copy(d[41*BlockSize:], "hello, world")
+
+	files, err := Catalog(d)
+	if err != nil {
+		t.Fatalf("could not read catalog: %v", err)
+	}
+	if len(files) != 3 || files[0].Path != "/CAT/SAP" || !files[1].IsDir() || files[2].Path != "/CAT/DIR/NOTE" {
+		t.Fatalf("unexpected catalog %+v", files)
+	}
+	sap := files[0]
+	if sap.Size != 1100 || TypeName(sap.Type) != "BIN" ||
+		!sap.Modified.Equal(time.Date(1987, 12, 3, 13, 45, 0, 0, time.UTC)) {
+		t.Errorf("unexpected entry %+v", sap)
+	}
+	if year := files[2].Modified.Year(); year != 2005 {
+		t.Errorf("year 5 read as %d, expected 2005", year)
+	}
+
+	data, err := ReadFile(d, sap)
+	if err != nil || len(data) != 1100 {
+		t.Fatalf("read %d bytes: %v", len(data), err)
+	}
+	if data[0] != 'A' || data[BlockSize] != 0 || data[2*BlockSize] != 'C' {
+		t.Errorf("sapling file read wrongly")
+	}
+	if data, err = ReadFile(d, files[2]); err != nil || string(data) != "hello" {
+		t.Errorf("seedling file read as %q: %v", data, err)
+	}
+	if _, err = ReadFile(d, files[1]); err == nil {
+		t.Errorf("directory read as a file")
+	}
+}
+
+func TestExtended(t *testing.T) {
+	d := newVolume("EXT", 280, 280)
+	addEntry(d, VolumeDirBlock, 1, storageExtended, "FORKED", 60, 3)
+	setFile(d, VolumeDirBlock, 1, 0x06, BlockSize, 0) // The key block's length
+	key := d[60*BlockSize:]
+	key[offDataFork], key[offDataFork+offForkKey], key[offDataFork+offForkEOF] = storageSeedling, 61, 100
+	key[offResourceFork], key[offResourceFork+offForkKey], key[offResourceFork+offForkEOF] = storageSeedling, 62, 200
+	copy(d[61*BlockSize:], "data fork")
+	copy(d[62*BlockSize:], "resource fork")
+
+	owners, err := Owners(d)
+	if err != nil {
+		t.Fatalf("could not read owners: %v", err)
+	}
+	for block, owner := range map[int]string{
+		60: "/EXT/FORKED",
+		61: "/EXT/FORKED",
+		62: "/EXT/FORKED (resource fork)",
+	} {
+		if owners[block] != owner {
+			t.Errorf("block %d owned by %q, expected %q", block, owners[block], owner)
+		}
+	}
+
+	files, err := Catalog(d)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected catalog %+v: %v", files, err)
+	}
+	if files[0].Size != 100 {
+		t.Errorf("extended file has size %d, expected its data fork's 100", files[0].Size)
+	}
+	data, err := ReadFile(d, files[0])
+	if err != nil || len(data) != 100 || string(data[:9]) != "data fork" {
+		t.Errorf("data fork read as %q: %v", data, err)
+	}
+}
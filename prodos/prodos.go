@@ -0,0 +1,241 @@
+// Package prodos reads and adjusts the volume-level structures of a
+// ProDOS filesystem: the volume directory header and the free block
+// bitmap. Documentation is in Beneath Apple ProDOS and the ProDOS 8
+// Technical Reference Manual, appendix B.
+package prodos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockSize is the size of a ProDOS block
+const BlockSize = 512
+
+// VolumeDirBlock is the block holding the volume directory header
+const VolumeDirBlock = 2
+
+// MaxBlocks is the largest number of blocks a ProDOS volume can hold
+const MaxBlocks = 65535
+
+// blocksPerBitmapBlock is the number of blocks one bitmap block tracks
+const blocksPerBitmapBlock = BlockSize * 8
+
+// Volume directory header layout, relative to the start of its block
+const (
+	offStorageType = 0x04
+	offName        = 0x05
+	offEntryLength = 0x23
+	offEntries     = 0x24
+	offFileCount   = 0x25
+	offBitmap      = 0x27
+	offTotalBlocks = 0x29
+
+	storageVolume = 0xf
+	entryLength   = 0x27
+	entriesPer    = 0x0d
+)
+
+// ErrNotProDOS is returned when no ProDOS volume directory is found
+var ErrNotProDOS = errors.New("not a ProDOS volume")
+
+// Device is a ProDOS-ordered block device that can be read and written
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Volume is the parsed volume directory header
+type Volume struct {
+	Name        string // Volume name, without the leading slash
+	FileCount   uint16 // Active entries in the volume directory
+	BitmapStart uint16 // First block of the free block bitmap
+	TotalBlocks uint16 // Size of the volume, in blocks
+}
+
+// BitmapBlocks returns the number of blocks the volume bitmap occupies
+func (v Volume) BitmapBlocks() int {
+	return bitmapBlocks(int(v.TotalBlocks))
+}
+
+func bitmapBlocks(total int) int {
+	return (total + blocksPerBitmapBlock - 1) / blocksPerBitmapBlock
+}
+
+// readBlock reads a whole block from r
+func readBlock(r io.ReaderAt, block int) ([]byte, error) {
+	buf := make([]byte, BlockSize)
+	read, err := r.ReadAt(buf, int64(block)*BlockSize)
+	if read == BlockSize {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// ReadVolume reads the volume directory header from a ProDOS-ordered
+// device. Returns ErrNotProDOS if there isn't one.
+func ReadVolume(r io.ReaderAt) (vol Volume, err error) {
+	block, err := readBlock(r, VolumeDirBlock)
+	if err != nil {
+		return vol, ErrNotProDOS
+	}
+	if block[0] != 0 || block[1] != 0 ||
+		block[offStorageType]>>4 != storageVolume ||
+		block[offEntryLength] != entryLength || block[offEntries] != entriesPer {
+		return vol, ErrNotProDOS
+	}
+	nameLen := int(block[offStorageType] & 0x0f)
+	vol.Name = string(block[offName : offName+nameLen])
+	vol.FileCount = binary.LittleEndian.Uint16(block[offFileCount:])
+	vol.BitmapStart = binary.LittleEndian.Uint16(block[offBitmap:])
+	vol.TotalBlocks = binary.LittleEndian.Uint16(block[offTotalBlocks:])
+	if vol.TotalBlocks <= VolumeDirBlock || vol.BitmapStart <= VolumeDirBlock ||
+		int(vol.BitmapStart)+vol.BitmapBlocks() > int(vol.TotalBlocks) {
+		return vol, fmt.Errorf("volume %s has an invalid bitmap or size", vol.Name)
+	}
+	return vol, nil
+}
+
+// IsProDOS returns true if r holds a ProDOS volume
+func IsProDOS(r io.ReaderAt) bool {
+	_, err := ReadVolume(r)
+	return err == nil
+}
+
+// Bitmap is a volume's free block bitmap. Each bit is set if the block
+// it represents is free; the high bit of each byte is the lowest block.
+type Bitmap []byte
+
+// Free returns true if a block is marked free
+func (b Bitmap) Free(block int) bool {
+	if block < 0 || block/8 >= len(b) {
+		return false
+	}
+	return b[block/8]&(0x80>>uint(block%8)) != 0
+}
+
+// SetFree marks a block free or in use
+func (b Bitmap) SetFree(block int, free bool) {
+	if free {
+		b[block/8] |= 0x80 >> uint(block%8)
+	} else {
+		b[block/8] &^= 0x80 >> uint(block%8)
+	}
+}
+
+// HighestUsed returns the highest block below total that is in use
+func (b Bitmap) HighestUsed(total int) int {
+	for block := total - 1; block > 0; block-- {
+		if !b.Free(block) {
+			return block
+		}
+	}
+	return 0
+}
+
+// ReadBitmap reads the free block bitmap of a volume
+func ReadBitmap(r io.ReaderAt, vol Volume) (Bitmap, error) {
+	bitmap := make(Bitmap, 0, vol.BitmapBlocks()*BlockSize)
+	for i := 0; i < vol.BitmapBlocks(); i++ {
+		block, err := readBlock(r, int(vol.BitmapStart)+i)
+		if err != nil {
+			return nil, fmt.Errorf("could not read bitmap block %d: %v", int(vol.BitmapStart)+i, err)
+		}
+		bitmap = append(bitmap, block...)
+	}
+	return bitmap, nil
+}
+
+// Resize changes the size of the volume on d to blocks, updating the
+// volume directory header and the free block bitmap. Growing a volume
+// may need more bitmap blocks; if the blocks following the bitmap are
+// in use, the whole bitmap moves to the start of the added space.
+// Shrinking fails if any block past the new end is in use. Returns the
+// updated volume header.
+func Resize(d Device, blocks int) (vol Volume, err error) {
+	vol, err = ReadVolume(d)
+	if err != nil {
+		return
+	}
+	if blocks > MaxBlocks {
+		return vol, fmt.Errorf("%d blocks is larger than the ProDOS maximum of %d", blocks, MaxBlocks)
+	}
+	bitmap, err := ReadBitmap(d, vol)
+	if err != nil {
+		return
+	}
+
+	total := int(vol.TotalBlocks)
+	start := int(vol.BitmapStart)
+	oldCount, newCount := bitmapBlocks(total), bitmapBlocks(blocks)
+
+	if blocks < total {
+		// Release bitmap blocks that are no longer needed, then
+		// check nothing else lives past the new end
+		for i := newCount; i < oldCount; i++ {
+			bitmap.SetFree(start+i, true)
+		}
+		if used := bitmap.HighestUsed(total); used >= blocks {
+			return vol, fmt.Errorf("block %d is in use; the volume can't shrink below %d blocks",
+				used, used+1)
+		}
+		bitmap = bitmap[:newCount*BlockSize]
+		for block := blocks; block < newCount*blocksPerBitmapBlock; block++ {
+			bitmap.SetFree(block, false)
+		}
+	} else {
+		// Extra bitmap blocks go directly after the existing bitmap if
+		// they're free, or else the bitmap moves to the added space
+		newStart := start
+		for i := oldCount; i < newCount; i++ {
+			if block := start + i; block < total && !bitmap.Free(block) {
+				newStart = total
+				break
+			}
+		}
+		bitmap = append(bitmap, make(Bitmap, (newCount-oldCount)*BlockSize)...)
+		for block := total; block < blocks; block++ {
+			bitmap.SetFree(block, true)
+		}
+		if newStart != start {
+			for i := 0; i < oldCount; i++ {
+				bitmap.SetFree(start+i, true)
+			}
+			start = newStart
+		}
+		if start+newCount > blocks {
+			return vol, fmt.Errorf("volume of %d blocks is too small to hold its bitmap", blocks)
+		}
+		for i := 0; i < newCount; i++ {
+			bitmap.SetFree(start+i, false)
+		}
+	}
+	if start+newCount > blocks {
+		return vol, fmt.Errorf("volume of %d blocks is too small to hold its bitmap", blocks)
+	}
+
+	// Write the bitmap, then the header, so a moved bitmap is only used
+	// once it's complete
+	for i := 0; i < newCount; i++ {
+		_, err = d.WriteAt(bitmap[i*BlockSize:(i+1)*BlockSize], int64(start+i)*BlockSize)
+		if err != nil {
+			return vol, fmt.Errorf("could not write bitmap block %d: %v", start+i, err)
+		}
+	}
+	header, err := readBlock(d, VolumeDirBlock)
+	if err != nil {
+		return
+	}
+	binary.LittleEndian.PutUint16(header[offTotalBlocks:], uint16(blocks))
+	binary.LittleEndian.PutUint16(header[offBitmap:], uint16(start))
+	if _, err = d.WriteAt(header, VolumeDirBlock*BlockSize); err != nil {
+		return vol, fmt.Errorf("could not write volume directory: %v", err)
+	}
+	vol.TotalBlocks, vol.BitmapStart = uint16(blocks), uint16(start)
+	return vol, nil
+}
@@ -0,0 +1,181 @@
+package prodos
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// memDevice is an in-memory block device
+type memDevice []byte
+
+func (m memDevice) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+// testBitmapStart is where a freshly formatted volume keeps its bitmap,
+// after the boot blocks and a four block volume directory
+const testBitmapStart = 6
+
+// newVolume returns a freshly formatted volume of the given size, in a
+// device of deviceBlocks blocks
+func newVolume(name string, blocks, deviceBlocks int) memDevice {
+	d := make(memDevice, deviceBlocks*BlockSize)
+	header := d[VolumeDirBlock*BlockSize:]
+	header[offStorageType] = storageVolume<<4 | byte(len(name))
+	copy(header[offName:], name)
+	header[offEntryLength] = entryLength
+	header[offEntries] = entriesPer
+	binary.LittleEndian.PutUint16(header[offBitmap:], testBitmapStart)
+	binary.LittleEndian.PutUint16(header[offTotalBlocks:], uint16(blocks))
+
+	count := bitmapBlocks(blocks)
+	bitmap := Bitmap(d[testBitmapStart*BlockSize : (testBitmapStart+count)*BlockSize])
+	for block := testBitmapStart + count; block < blocks; block++ {
+		bitmap.SetFree(block, true)
+	}
+	return d
+}
+
+func TestReadVolume(t *testing.T) {
+	vol, err := ReadVolume(newVolume("TEST.VOL", 280, 280))
+	if err != nil {
+		t.Fatalf("could not read volume: %v", err)
+	}
+	if vol.Name != "TEST.VOL" || vol.TotalBlocks != 280 || vol.BitmapStart != testBitmapStart {
+		t.Errorf("unexpected volume header %+v", vol)
+	}
+	if _, err = ReadVolume(make(memDevice, 280*BlockSize)); err != ErrNotProDOS {
+		t.Errorf("blank device returned %v, expected ErrNotProDOS", err)
+	}
+}
+
+func TestResizeGrow(t *testing.T) {
+	d := newVolume("GROW", 280, MaxBlocks)
+	vol, err := Resize(d, MaxBlocks)
+	if err != nil {
+		t.Fatalf("could not grow volume: %v", err)
+	}
+	if vol.TotalBlocks != MaxBlocks {
+		t.Errorf("resize returned %d blocks", vol.TotalBlocks)
+	}
+	vol, err = ReadVolume(d)
+	if err != nil {
+		t.Fatalf("could not reread volume: %v", err)
+	}
+	if vol.TotalBlocks != MaxBlocks || vol.BitmapBlocks() != 16 {
+		t.Errorf("volume has %d blocks and %d bitmap blocks", vol.TotalBlocks, vol.BitmapBlocks())
+	}
+	bitmap, err := ReadBitmap(d, vol)
+	if err != nil {
+		t.Fatalf("could not read bitmap: %v", err)
+	}
+	for block, free := range map[int]bool{
+		testBitmapStart:      false,
+		testBitmapStart + 15: false,
+		testBitmapStart + 16: true,
+		279:                  true,
+		280:                  true,
+		MaxBlocks - 1:        true,
+		MaxBlocks:            false,
+	} {
+		if bitmap.Free(block) != free {
+			t.Errorf("block %d free is %v, expected %v", block, !free, free)
+		}
+	}
+}
+
+func TestResizeGrowPopulated(t *testing.T) {
+	// A full 800K volume, with files right after its bitmap
+	d := newVolume("FULL", 1600, MaxBlocks)
+	vol, _ := ReadVolume(d)
+	bitmap, _ := ReadBitmap(d, vol)
+	for block := 0; block < 1600; block++ {
+		bitmap.SetFree(block, false)
+	}
+	copy(d[testBitmapStart*BlockSize:], bitmap)
+	file := d[(testBitmapStart+1)*BlockSize : (testBitmapStart+2)*BlockSize]
+	for i := range file {
+		file[i] = 0x5a
+	}
+
+	vol, err := Resize(d, MaxBlocks)
+	if err != nil {
+		t.Fatalf("could not grow populated volume: %v", err)
+	}
+	if vol.BitmapStart != 1600 {
+		t.Errorf("bitmap moved to block %d, expected 1600", vol.BitmapStart)
+	}
+	reread, err := ReadVolume(d)
+	if err != nil {
+		t.Fatalf("could not reread volume: %v", err)
+	}
+	if reread != vol {
+		t.Errorf("volume header reads %+v, expected %+v", reread, vol)
+	}
+	for i := range file {
+		if file[i] != 0x5a {
+			t.Fatalf("file block after the old bitmap was overwritten")
+		}
+	}
+	bitmap, err = ReadBitmap(d, vol)
+	if err != nil {
+		t.Fatalf("could not read bitmap: %v", err)
+	}
+	for block, free := range map[int]bool{
+		testBitmapStart:     true, // The old bitmap
+		testBitmapStart + 1: false,
+		1599:                false,
+		1600:                false, // The new bitmap
+		1615:                false,
+		1616:                true,
+		MaxBlocks - 1:       true,
+	} {
+		if bitmap.Free(block) != free {
+			t.Errorf("block %d free is %v, expected %v", block, !free, free)
+		}
+	}
+
+	// Growing by too little to hold a moved bitmap fails
+	d = newVolume("FULL", 4096, 4097)
+	bitmap = Bitmap(d[testBitmapStart*BlockSize:])
+	bitmap.SetFree(testBitmapStart+1, false)
+	if _, err = Resize(d, 4097); err == nil {
+		t.Errorf("grew into too little space to move the bitmap")
+	}
+	if _, err = Resize(d, 4096); err != nil {
+		t.Errorf("could not resize within one bitmap block: %v", err)
+	}
+}
+
+func TestResizeShrink(t *testing.T) {
+	d := newVolume("SHRINK", 20000, 20000)
+	vol, _ := ReadVolume(d)
+	bitmap, _ := ReadBitmap(d, vol)
+	bitmap.SetFree(100, false)
+	copy(d[testBitmapStart*BlockSize:], bitmap)
+
+	if _, err := Resize(d, 100); err == nil {
+		t.Errorf("shrank past a used block")
+	}
+	vol, err := Resize(d, 101)
+	if err != nil {
+		t.Fatalf("could not shrink: %v", err)
+	}
+	if vol.BitmapBlocks() != 1 {
+		t.Errorf("volume kept %d bitmap blocks", vol.BitmapBlocks())
+	}
+	bitmap, err = ReadBitmap(d, vol)
+	if err != nil {
+		t.Fatalf("could not read bitmap: %v", err)
+	}
+	if used := bitmap.HighestUsed(int(vol.TotalBlocks)); used != 100 {
+		t.Errorf("highest used block is %d, expected 100", used)
+	}
+	if bitmap.Free(101) || !bitmap.Free(99) {
+		t.Errorf("bitmap not trimmed to the new volume size")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// Progress reporting modes
+const (
+	progressAuto = "auto" // Text on a terminal, otherwise nothing
+	progressJSON = "json" // One JSON object per line
+	progressNone = "none"
+)
+
+// progressInterval is the least time between progress reports
+const progressInterval = 250 * time.Millisecond
+
+// progress passes through data being copied, reporting how the copy
+// is going on stderr
+type progress struct {
+	r       io.Reader
+	label   string
+	total   int64
+	done    int64
+	mode    string
+	started time.Time
+	last    time.Time
+	out     io.Writer
+}
+
+// progressLine is a machine-readable progress report
+type progressLine struct {
+	Operation string  `json:"operation"`
+	Bytes     int64   `json:"bytes"`
+	Total     int64   `json:"total"`
+	Blocks    int64   `json:"blocks"`
+	Rate      float64 `json:"rate"`        // Bytes per second
+	ETA       float64 `json:"eta_seconds"` // Estimated seconds remaining
+	Done      bool    `json:"done"`
+}
+
+// stderrIsTerminal returns true if stderr looks like a terminal
+func stderrIsTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgress returns a reader of r that reports progress reading its
+// total bytes, or -1 if that isn't known, as chosen with --progress
+func newProgress(label string, r io.Reader, total int64) *progress {
+	mode := cli.Progress
+	if mode == progressAuto && !stderrIsTerminal() {
+		mode = progressNone
+	}
+	now := time.Now()
+	return &progress{r: r, label: label, total: total,
+		mode: mode, started: now, last: now, out: os.Stderr}
+}
+
+// Read reads data, counting it
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(int64(n))
+	return n, err
+}
+
+// add counts copied bytes, reporting if it's been long enough
+func (p *progress) add(n int64) {
+	p.done += n
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.report(false)
+	}
+}
+
+// Finish reports the final state of the copy
+func (p *progress) Finish() {
+	p.report(true)
+}
+
+// report writes a progress report in the chosen mode
+func (p *progress) report(done bool) {
+	if p.mode == progressNone {
+		return
+	}
+	elapsed := time.Since(p.started).Seconds()
+	var rate, eta float64
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	if rate > 0 && p.total > p.done {
+		eta = float64(p.total-p.done) / rate
+	}
+
+	if p.mode == progressJSON {
+		line, _ := json.Marshal(progressLine{
+			Operation: p.label,
+			Bytes:     p.done,
+			Total:     p.total,
+			Blocks:    p.done / mdturbo.SectorSize,
+			Rate:      rate,
+			ETA:       eta,
+			Done:      done,
+		})
+		fmt.Fprintf(p.out, "%s\n", line)
+		return
+	}
+
+	if p.total < 0 {
+		line := fmt.Sprintf("%s: %s, %d blocks, %s/s", p.label, humanBytes(p.done),
+			p.done/mdturbo.SectorSize, humanBytes(int64(rate)))
+		p.print(line, done)
+		return
+	}
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.done) * 100 / float64(p.total)
+	}
+	line := fmt.Sprintf("%s: %s of %s (%.0f%%), %d blocks, %s/s",
+		p.label, humanBytes(p.done), humanBytes(p.total), percent,
+		p.done/mdturbo.SectorSize, humanBytes(int64(rate)))
+	if !done {
+		line += ", ETA " + (time.Duration(eta) * time.Second).String()
+	}
+	p.print(line, done)
+}
+
+// print writes a text progress line over the previous one
+func (p *progress) print(line string, done bool) {
+	// Pad to overwrite the end of a longer previous line
+	fmt.Fprintf(p.out, "\r%-79s", line)
+	if done {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// humanBytes formats a byte count with a binary unit suffix
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KMGT"
+	for i := 0; i < len(suffix); i++ {
+		if value < unit || i == len(suffix)-1 {
+			return fmt.Sprintf("%.1f %ciB", value, suffix[i])
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// stdioName is the filename meaning stdin or stdout
+const stdioName = "-"
+
+// streamHeadSize is how much of the start of a stream is kept, so that
+// image headers can be read more than once, and short images, such as
+// DOS-order disks, can be read in any order.
+const streamHeadSize = 1024 * 1024
+
+// errStreamBackwards is returned when a stream would need to be reread
+var errStreamBackwards = errors.New("can't go back in a stream; use a file instead")
+
+// streamSource is an image read from a pipe, such as stdin. It works
+// as an io.ReaderAt as long as reads past the first streamHeadSize
+// bytes only ever move forward.
+type streamSource struct {
+	r    io.Reader
+	name string
+	head []byte // The start of the stream
+	pos  int64  // Position of r in the stream
+	eof  bool   // r has no more data
+}
+
+// newStreamSource returns a source reading from r
+func newStreamSource(r io.Reader, name string) *streamSource {
+	return &streamSource{r: r, name: name}
+}
+
+// Name returns the name of the stream
+func (s *streamSource) Name() string {
+	return s.name
+}
+
+// Close does nothing; the stream belongs to the caller
+func (s *streamSource) Close() error {
+	return nil
+}
+
+// fillHead reads from the stream until the head holds want bytes, or
+// the stream ends
+func (s *streamSource) fillHead(want int) error {
+	for len(s.head) < want && !s.eof {
+		buf := make([]byte, want-len(s.head))
+		read, err := io.ReadFull(s.r, buf)
+		s.head = append(s.head, buf[:read]...)
+		s.pos += int64(read)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadAt reads from the stream. Anything in the head can be read at
+// any time; past that, reads must not go backwards.
+func (s *streamSource) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < streamHeadSize {
+			want := pos + int64(len(p)-n)
+			if want > streamHeadSize {
+				want = streamHeadSize
+			}
+			if err = s.fillHead(int(want)); err != nil {
+				return n, err
+			}
+			if pos >= int64(len(s.head)) {
+				return n, io.EOF
+			}
+			n += copy(p[n:], s.head[pos:])
+			continue
+		}
+
+		// Past the head, read straight from the stream
+		if err = s.fillHead(streamHeadSize); err != nil {
+			return n, err
+		}
+		if pos < s.pos {
+			return n, errStreamBackwards
+		}
+		if s.eof {
+			return n, io.EOF
+		}
+		if pos > s.pos {
+			skipped, err := io.CopyN(ioutil.Discard, s.r, pos-s.pos)
+			s.pos += skipped
+			if err == io.EOF {
+				s.eof = true
+				return n, io.EOF
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+		read, err := io.ReadFull(s.r, p[n:])
+		s.pos += int64(read)
+		n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.eof = true
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
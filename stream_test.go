@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// streamData returns data of length bytes that differs from block to
+// block, so a read from the wrong place shows
+func streamData(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i/512 + i)
+	}
+	return data
+}
+
+func TestStreamSource(t *testing.T) {
+	data := streamData(streamHeadSize + 64*1024)
+	s := newStreamSource(bytes.NewReader(data), "test")
+	buf := make([]byte, 1024)
+
+	// The head can be read in any order
+	for _, off := range []int64{4096, 0, streamHeadSize - 1024, 512} {
+		read, err := s.ReadAt(buf, off)
+		if err != nil || read != len(buf) {
+			t.Fatalf("read of head at %d returned %d bytes, %v", off, read, err)
+		}
+		if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+			t.Errorf("read of head at %d returned the wrong data", off)
+		}
+	}
+
+	// Past it, reads move forward, skipping as need be, across the end
+	// of the head
+	for _, off := range []int64{streamHeadSize - 512, streamHeadSize + 4096, streamHeadSize + 8192} {
+		read, err := s.ReadAt(buf, off)
+		if err != nil || read != len(buf) {
+			t.Fatalf("forward read at %d returned %d bytes, %v", off, read, err)
+		}
+		if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+			t.Errorf("forward read at %d returned the wrong data", off)
+		}
+	}
+
+	// Going back past the head fails, rather than returning what's next
+	// in the stream
+	for _, off := range []int64{streamHeadSize + 4096, streamHeadSize} {
+		if read, err := s.ReadAt(buf, off); err != errStreamBackwards {
+			t.Errorf("backward read at %d returned %d bytes, %v; expected %v",
+				off, read, err, errStreamBackwards)
+		}
+	}
+
+	// The head is still there, and the stream ends where it should
+	if read, err := s.ReadAt(buf, 0); err != nil || read != len(buf) || !bytes.Equal(buf, data[:len(buf)]) {
+		t.Errorf("read of head after going forward returned %d bytes, %v", read, err)
+	}
+	end := int64(len(data)) - 512
+	read, err := s.ReadAt(buf, end)
+	if err != io.EOF || read != 512 || !bytes.Equal(buf[:read], data[end:]) {
+		t.Errorf("read across the end returned %d bytes, %v; expected 512 bytes and EOF", read, err)
+	}
+}
+
+func TestStreamSourceShort(t *testing.T) {
+	// A stream shorter than the head can be read in any order
+	data := streamData(140 * 1024)
+	s := newStreamSource(bytes.NewReader(data), "test")
+	buf := make([]byte, 512)
+	for _, off := range []int64{100 * 1024, 0, 139 * 1024} {
+		read, err := s.ReadAt(buf, off)
+		if err != nil || read != len(buf) || !bytes.Equal(buf, data[off:off+512]) {
+			t.Errorf("read at %d returned %d bytes, %v", off, read, err)
+		}
+	}
+	if read, err := s.ReadAt(buf, int64(len(data))); err != io.EOF || read != 0 {
+		t.Errorf("read past the end returned %d bytes, %v; expected EOF", read, err)
+	}
+}
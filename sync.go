@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/chunks"
+	"github.com/disappearinjon/microdrive/diskimage"
+	"github.com/disappearinjon/microdrive/journal"
+	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/transfer"
+)
+
+// SyncCmd brings a card up to date with an image of it, writing only
+// the parts that differ
+type SyncCmd struct {
+	Source string `arg:"positional,required" help:"Microdrive/Turbo image file holding what the card should hold"`
+	Target string `arg:"positional,required" help:"Card to update: a device such as /dev/sdb, or an image file"`
+	Hashes string `help:"Hash manifest of the card, saved after each sync; if it exists, it's used instead of reading the whole card"`
+}
+
+func syncCard(ctx context.Context) error {
+	if err := refuseCompressed(cli.Sync.Target); err != nil {
+		return err
+	}
+	source, err := openCardImage(cli.Sync.Source)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	length, err := diskimage.Size(source.ReaderAt)
+	if err != nil {
+		return fmt.Errorf("could not get the size of %s: %v", cli.Sync.Source, err)
+	}
+	target, err := openTarget(cli.Sync.Target, false)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", cli.Sync.Target, err)
+	}
+	defer target.Close()
+	if target.device != nil && length > target.Size() {
+		return fmt.Errorf("%s (%d bytes) is larger than %s (%d bytes)",
+			cli.Sync.Source, length, cli.Sync.Target, target.Size())
+	}
+
+	// Find what needs writing
+	old := loadHashes(cli.Sync.Hashes, cli.Sync.Target, target)
+	report := newProgress("Comparing", io.NewSectionReader(source, 0, length), length)
+	changed, hashes, err := chunks.Changed(ctx, report, target, old, chunks.Size)
+	report.Finish()
+	if err != nil {
+		return fmt.Errorf("could not compare %s with %s: %v", cli.Sync.Source, cli.Sync.Target, err)
+	}
+	ranges := chunkRanges(changed, chunks.Size, length)
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	summary := fmt.Sprintf("%d of %d blocks", total/mdturbo.SectorSize, length/mdturbo.SectorSize)
+	if len(ranges) == 1 {
+		summary += " in 1 region"
+	} else if len(ranges) > 1 {
+		summary += fmt.Sprintf(" in %d regions", len(ranges))
+	}
+
+	// An image file larger than the source is cut down to match it
+	resize := target.device == nil && target.Size() > length
+	if cli.DryRun {
+		return dryRunSync(source, ranges, summary, resize, length)
+	}
+	if len(ranges) == 0 && !resize {
+		fmt.Fprintf(os.Stderr, "%s is already up to date\n", cli.Sync.Target)
+		return saveHashes(hashes)
+	}
+	undoRanges := ranges
+	if resize {
+		undoRanges = append(undoRanges, journal.Range{Offset: length, Length: target.Size() - length})
+	}
+	if err = saveUndo(target, undoRanges...); err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		if err = target.Truncate(length); err != nil {
+			return fmt.Errorf("could not resize %s: %v", cli.Sync.Target, err)
+		}
+		if err = target.Commit(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Cut %s down to %d bytes\n", cli.Sync.Target, length)
+		return saveHashes(hashes)
+	}
+
+	// Hold back the partition table, to write once the data it describes
+	// is on the card
+	data := append([]journal.Range(nil), ranges...)
+	var table *mdturbo.MDTurbo
+	if data[0].Offset == 0 && data[0].Length >= mdturbo.PartitionBlkLen {
+		var sector [mdturbo.PartitionBlkLen]byte
+		if _, err = source.ReadAt(sector[:], 0); err != nil {
+			return fmt.Errorf("could not read %s: %v", cli.Sync.Source, err)
+		}
+		parsed, err := mdturbo.Deserialize(sector)
+		if err != nil {
+			return err
+		}
+		table = &parsed
+		data[0].Offset += mdturbo.PartitionBlkLen
+		data[0].Length -= mdturbo.PartitionBlkLen
+	}
+
+	// Write the rest, as one stream for progress reports
+	sections := make([]io.Reader, len(data))
+	var streamed int64
+	for i, r := range data {
+		sections[i] = io.NewSectionReader(source, r.Offset, r.Length)
+		streamed += r.Length
+	}
+	report = newProgress("Writing", io.MultiReader(sections...), streamed)
+	for _, r := range data {
+		if _, err = transfer.CopyAt(ctx, target, r.Offset, report, r.Length); err != nil {
+			break
+		}
+	}
+	report.Finish()
+	if transfer.IsCancelled(err) != nil {
+		return fmt.Errorf("sync was %v; %s is only partly up to date", err, cli.Sync.Target)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", cli.Sync.Target, err)
+	}
+	if table != nil {
+		if err = transfer.WriteTable(target, *table); err != nil {
+			return fmt.Errorf("could not write %s: %v", cli.Sync.Target, err)
+		}
+	}
+	if resize {
+		if err = target.Truncate(length); err != nil {
+			return fmt.Errorf("could not resize %s: %v", cli.Sync.Target, err)
+		}
+	}
+	if err = target.Commit(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Rewrote %s\n", summary)
+	return saveHashes(hashes)
+}
+
+// saveHashes saves the hash manifest of a card just synced, if asked,
+// stamped with the card's state now that the sync is done
+func saveHashes(hashes *chunks.Manifest) error {
+	if cli.Sync.Hashes == "" {
+		return nil
+	}
+	fi, err := os.Stat(cli.Sync.Target)
+	if err != nil {
+		return fmt.Errorf("could not save hash manifest %s: %v", cli.Sync.Hashes, err)
+	}
+	hashes.Stamp(fi)
+	if err := hashes.Save(cli.Sync.Hashes); err != nil {
+		return fmt.Errorf("could not save hash manifest %s: %v", cli.Sync.Hashes, err)
+	}
+	return nil
+}
+
+// loadHashes reads a saved hash manifest of a card, returning nil if
+// there's none to use. The card's file is named cardFile; card may be
+// a copy of it.
+func loadHashes(filename, cardFile string, card io.ReaderAt) *chunks.Manifest {
+	if filename == "" {
+		return nil
+	}
+	m, err := chunks.Load(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v; reading the whole card instead\n", err)
+		return nil
+	}
+	fi, err := os.Stat(cardFile)
+	if err != nil || !m.Matches(card, fi) {
+		fmt.Fprintf(os.Stderr, "WARNING: hash manifest %s doesn't match the card, or the card has changed since; reading the whole card instead\n", filename)
+		return nil
+	}
+	return m
+}
+
+// chunkRanges merges the offsets of changed chunks into ranges, the
+// last cut short at the end of an image of length bytes
+func chunkRanges(changed []int64, chunkSize, length int64) (ranges []journal.Range) {
+	for _, offset := range changed {
+		end := offset + chunkSize
+		if end > length {
+			end = length
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == offset {
+			ranges[n-1].Length = end - ranges[n-1].Offset
+			continue
+		}
+		ranges = append(ranges, journal.Range{Offset: offset, Length: end - offset})
+	}
+	return ranges
+}
+
+// dryRunSync prints what a sync would write
+func dryRunSync(source io.ReaderAt, ranges []journal.Range, summary string, resize bool, length int64) error {
+	before, err := GetPartitionTable(cli.Sync.Target)
+	if err != nil {
+		return err
+	}
+	var sector [mdturbo.PartitionBlkLen]byte
+	if _, err = source.ReadAt(sector[:], 0); err != nil {
+		return err
+	}
+	after, err := mdturbo.Deserialize(sector)
+	if err != nil {
+		return err
+	}
+	writes := make([]plannedWrite, len(ranges))
+	for i, r := range ranges {
+		writes[i] = plannedWrite{r, "changed data from " + cli.Sync.Source}
+	}
+	dryRun(cli.Sync.Target, before, after, writes)
+	fmt.Printf("Would rewrite %s\n", summary)
+	if resize {
+		fmt.Printf("Would set the size of %s to %d bytes\n", cli.Sync.Target, length)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/blockdev"
+)
+
+// targetCard is a card image opened for changing. Normally changes are
+// made in place. In copy-on-write mode they're made to a copy beside
+// the original, which replaces it only when they're committed, so the
+// original is never left half-changed.
+type targetCard struct {
+	*os.File
+	name      string // Name of the card image
+	copied    bool   // File is a copy of the card image
+	committed bool
+	device    *blockdev.Device // Set if the card is a block device
+}
+
+// openTarget opens a card image or device for changing, creating an
+// image if create is set. For a dry run, it is opened only for reading.
+func openTarget(filename string, create bool) (*targetCard, error) {
+	if cli.CopyOnWrite && !cli.DryRun {
+		// A new card has no original to protect
+		if _, err := os.Stat(filename); !(os.IsNotExist(err) && create) {
+			return copyTarget(filename)
+		}
+	}
+	if isDevice(filename) {
+		return openTargetDevice(filename)
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	if cli.DryRun {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &targetCard{File: file, name: filename}, nil
+}
+
+// openTargetDevice opens a block device for changing
+func openTargetDevice(filename string) (*targetCard, error) {
+	flag := os.O_RDWR
+	if cli.DryRun {
+		flag = os.O_RDONLY
+	}
+	device, err := openDevice(filename, flag)
+	if err != nil {
+		return nil, err
+	}
+	return &targetCard{File: device.File, name: filename, device: device}, nil
+}
+
+// ReadAt reads from the card, in whole sectors if it's a device
+func (t *targetCard) ReadAt(p []byte, off int64) (int, error) {
+	if t.device != nil {
+		return t.device.ReadAt(p, off)
+	}
+	return t.File.ReadAt(p, off)
+}
+
+// WriteAt writes to the card, in whole sectors if it's a device
+func (t *targetCard) WriteAt(p []byte, off int64) (int, error) {
+	if t.device != nil {
+		return t.device.WriteAt(p, off)
+	}
+	return t.File.WriteAt(p, off)
+}
+
+// Size returns the size of the card in bytes, or -1 if it isn't known
+func (t *targetCard) Size() int64 {
+	if t.device != nil {
+		return t.device.Size()
+	}
+	fi, err := t.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
+}
+
+// copyTarget copies a card image to a temporary file in the same
+// directory, so it can later be renamed over the original
+func copyTarget(filename string) (*targetCard, error) {
+	original, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+	fi, err := original.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not an image file, so it can't be copied on write", filename)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return nil, fmt.Errorf("could not make a copy of %s: %v", filename, err)
+	}
+	card := &targetCard{File: temp, name: filename, copied: true}
+	if err = temp.Chmod(fi.Mode().Perm()); err != nil {
+		card.Close()
+		return nil, err
+	}
+	report := newProgress("Copying", original, fi.Size())
+	_, err = io.Copy(temp, report)
+	report.Finish()
+	if err != nil {
+		card.Close()
+		return nil, fmt.Errorf("could not make a copy of %s: %v", filename, err)
+	}
+	return card, nil
+}
+
+// Commit makes the changes to a card permanent. In copy-on-write mode,
+// the changed copy is synced and renamed over the original.
+func (t *targetCard) Commit() error {
+	if err := t.File.Sync(); err != nil {
+		return err
+	}
+	if !t.copied {
+		return nil
+	}
+	if err := t.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(t.File.Name(), t.name); err != nil {
+		os.Remove(t.File.Name())
+		return fmt.Errorf("could not replace %s with its changed copy: %v", t.name, err)
+	}
+	t.committed = true
+
+	// Make sure the rename itself is on disk; not every system can sync
+	// a directory, so this is best effort
+	if dir, err := os.Open(filepath.Dir(t.name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Close closes a card. In copy-on-write mode, a copy whose changes
+// weren't committed is removed, leaving the original as it was.
+func (t *targetCard) Close() error {
+	if t.committed {
+		return nil
+	}
+	err := t.File.Close()
+	if t.copied {
+		return os.Remove(t.File.Name())
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+// Package transfer copies disk images into and out of the partitions
+// of a Microdrive/Turbo card image. Copies are made in chunks, checking
+// between chunks whether their context has been cancelled; a cancelled
+// copy returns a *CancelledError saying how much was written.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// ChunkSize is the most data copied between checks for cancellation
+const ChunkSize = 64 * 1024
+
+// ErrTooLarge is returned when an image doesn't fit its partition
+var ErrTooLarge = errors.New("image is larger than the partition")
+
+// Card is a Microdrive/Turbo card image open for reading and writing
+type Card interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// syncer is a card that can flush its writes to stable storage, such as
+// an *os.File
+type syncer interface {
+	Sync() error
+}
+
+// CancelledError is returned when a copy is stopped by its context
+type CancelledError struct {
+	Written int64 // Bytes written before the copy stopped
+	Err     error // Why the context was cancelled
+}
+
+func (e *CancelledError) Error() string {
+	if e.Err == context.Canceled {
+		return fmt.Sprintf("cancelled after writing %d bytes", e.Written)
+	}
+	return fmt.Sprintf("cancelled after writing %d bytes: %v", e.Written, e.Err)
+}
+
+// IsCancelled returns the CancelledError in err, or nil if err isn't
+// one
+func IsCancelled(err error) *CancelledError {
+	var cancelled *CancelledError
+	if errors.As(err, &cancelled) {
+		return cancelled
+	}
+	return nil
+}
+
+// Copy copies from src to dst until src ends, or limit bytes have been
+// copied if limit isn't negative. Returns the number of bytes written.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, limit int64) (written int64, err error) {
+	buf := make([]byte, ChunkSize)
+	for limit < 0 || written < limit {
+		if err = ctx.Err(); err != nil {
+			return written, &CancelledError{Written: written, Err: err}
+		}
+		chunk := buf
+		if limit >= 0 && limit-written < int64(len(chunk)) {
+			chunk = chunk[:limit-written]
+		}
+		read, readErr := io.ReadFull(src, chunk)
+		if read > 0 {
+			wrote, err := dst.Write(chunk[:read])
+			written += int64(wrote)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+	return written, nil
+}
+
+// CopyAt copies length bytes from src to a card, starting at offset,
+// failing if src ends sooner. Returns the number of bytes written.
+func CopyAt(ctx context.Context, card Card, offset int64, src io.Reader, length int64) (written int64, err error) {
+	written, err = Copy(ctx, &offsetWriter{card, offset}, src, length)
+	if err == nil && written != length {
+		err = fmt.Errorf("expected %d bytes; copied %d", length, written)
+	}
+	return
+}
+
+// offsetWriter writes to a card sequentially, from an offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	written, err := o.w.WriteAt(b, o.offset)
+	o.offset += int64(written)
+	return written, err
+}
+
+// Import writes an image into a partition of a card, then zeroes the
+// rest of the partition unless keepTail is set. length is the size of
+// the image, or -1 if it isn't known, in which case src is read to its
+// end. An image larger than the partition fails with ErrTooLarge;
+// before anything is written if its length is known, or else once the
+// partition is full. Returns the number of image bytes written.
+func Import(ctx context.Context, card Card, partition mdturbo.Partition, src io.Reader, length int64, keepTail bool) (written int64, err error) {
+	start := int64(partition.Start) * mdturbo.SectorSize
+	size := int64(partition.Length()) * mdturbo.SectorSize
+	if length > size {
+		return 0, ErrTooLarge
+	}
+	limit := length
+	if limit < 0 {
+		limit = size
+	}
+
+	written, err = Copy(ctx, &offsetWriter{card, start}, src, limit)
+	if err != nil {
+		return
+	}
+	if length < 0 {
+		if extra, _ := src.Read(make([]byte, 1)); extra > 0 {
+			return written, ErrTooLarge
+		}
+	} else if written != length {
+		return written, fmt.Errorf("expected %d bytes; copied %d", length, written)
+	}
+
+	if !keepTail {
+		zeroes := &zeroReader{}
+		if _, err = Copy(ctx, &offsetWriter{card, start + written}, zeroes, size-written); err != nil {
+			if cancelled := IsCancelled(err); cancelled != nil {
+				// Report the image data written, not the zeroes
+				cancelled.Written = written
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// zeroReader reads endless zeroes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// Append copies an image into a new partition of the given number of
+// blocks, after the last partition of a card, and adds the partition to
+// partMap. The table on the card is not changed: write partMap with
+// WriteTable once everything else to be done to the partition is done,
+// so that the table never points at data that isn't there. If the copy
+// fails or is cancelled, partMap is left as it was.
+func Append(ctx context.Context, card Card, partMap *mdturbo.MDTurbo, blocks uint32, src io.Reader, length int64) (partNum uint8, written int64, err error) {
+	newMap := *partMap
+	num, err := newMap.AddPartition(blocks)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not add partition: %v", err)
+	}
+	partNum = uint8(num)
+	partition, err := newMap.GetPartition(partNum)
+	if err != nil {
+		return 0, 0, err
+	}
+	written, err = Import(ctx, card, partition, src, length, false)
+	if err != nil {
+		return partNum, written, err
+	}
+	*partMap = newMap
+	return partNum, written, nil
+}
+
+// Export copies length bytes of partition data from src to dst
+func Export(ctx context.Context, dst io.Writer, src io.Reader, length int64) (written int64, err error) {
+	written, err = Copy(ctx, dst, src, length)
+	if err == nil && written != length {
+		err = fmt.Errorf("expected %d bytes; copied %d", length, written)
+	}
+	return
+}
+
+// WriteTable writes a partition table to the start of a card. See
+// WriteTableAt.
+func WriteTable(card Card, partMap mdturbo.MDTurbo) error {
+	return WriteTableAt(card, 0, partMap)
+}
+
+// WriteTableAt writes a partition table to a card at offset, then reads
+// it back to check it. If the card can be synced, everything written
+// before is flushed to stable storage first, and the table after, so
+// the table is never written ahead of the data it describes.
+func WriteTableAt(card Card, offset int64, partMap mdturbo.MDTurbo) error {
+	serialized, err := partMap.Serialize()
+	if err != nil {
+		return fmt.Errorf("could not serialize partition table: %v", err)
+	}
+	s, canSync := card.(syncer)
+	if canSync {
+		if err = s.Sync(); err != nil {
+			return fmt.Errorf("could not flush data before the partition table: %v", err)
+		}
+	}
+	bytesWritten, err := card.WriteAt(serialized[:], offset)
+	if err != nil {
+		return fmt.Errorf("could not write partition table: %v", err)
+	}
+	if bytesWritten != len(serialized) {
+		return fmt.Errorf("partition table write unexpected length (got %d, expected %d)",
+			bytesWritten, len(serialized))
+	}
+	if canSync {
+		if err = s.Sync(); err != nil {
+			return fmt.Errorf("could not flush partition table: %v", err)
+		}
+	}
+
+	var readBack [mdturbo.PartitionBlkLen]byte
+	if _, err = card.ReadAt(readBack[:], offset); err != nil && err != io.EOF {
+		return fmt.Errorf("could not read back partition table: %v", err)
+	}
+	if readBack != serialized {
+		return fmt.Errorf("partition table read back differs from what was written")
+	}
+	return nil
+}
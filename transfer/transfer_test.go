@@ -0,0 +1,207 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// memCard is an in-memory card image that grows as it's written, like
+// a file
+type memCard struct {
+	data []byte
+}
+
+func (m *memCard) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	read := copy(p, m.data[off:])
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (m *memCard) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+// cancellingReader reads from r, cancelling a context once after bytes
+// have been read
+type cancellingReader struct {
+	r      io.Reader
+	after  int
+	cancel context.CancelFunc
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	read, err := c.r.Read(p)
+	if c.after -= read; c.after <= 0 {
+		c.cancel()
+	}
+	return read, err
+}
+
+// newTable returns a partition table with one partition of blocks
+func newTable(blocks uint32) mdturbo.MDTurbo {
+	partMap := mdturbo.MDTurbo{Magic: 52426}
+	partMap.AddPartition(blocks)
+	return partMap
+}
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte{0xa5}, 3*ChunkSize+100)
+	var out bytes.Buffer
+	written, err := Copy(context.Background(), &out, bytes.NewReader(data), -1)
+	if err != nil || written != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("copied %d bytes, error %v", written, err)
+	}
+
+	out.Reset()
+	written, err = Copy(context.Background(), &out, bytes.NewReader(data), 1000)
+	if err != nil || written != 1000 || out.Len() != 1000 {
+		t.Errorf("limited copy wrote %d bytes, error %v", written, err)
+	}
+}
+
+func TestCopyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data := make([]byte, 4*ChunkSize)
+	src := &cancellingReader{r: bytes.NewReader(data), after: ChunkSize, cancel: cancel}
+	written, err := Copy(ctx, ioutil.Discard, src, -1)
+	cancelled := IsCancelled(err)
+	if cancelled == nil {
+		t.Fatalf("copy was not cancelled: %v", err)
+	}
+	if written != ChunkSize || cancelled.Written != ChunkSize {
+		t.Errorf("cancelled copy wrote %d bytes, reported %d; expected %d",
+			written, cancelled.Written, ChunkSize)
+	}
+}
+
+func TestImport(t *testing.T) {
+	partMap := newTable(8)
+	partition, _ := partMap.GetPartition(0)
+	card := &memCard{data: bytes.Repeat([]byte{0xff}, 264*mdturbo.SectorSize)}
+	image := bytes.Repeat([]byte{0x42}, 3*mdturbo.SectorSize)
+
+	written, err := Import(context.Background(), card, partition, bytes.NewReader(image), -1, false)
+	if err != nil || written != int64(len(image)) {
+		t.Fatalf("import wrote %d bytes, error %v", written, err)
+	}
+	start := 256 * mdturbo.SectorSize
+	if !bytes.Equal(card.data[start:start+len(image)], image) {
+		t.Errorf("image not written to the partition")
+	}
+	tail := card.data[start+len(image):]
+	if !bytes.Equal(tail, make([]byte, len(tail))) {
+		t.Errorf("rest of the partition not zeroed")
+	}
+	if card.data[start-1] != 0xff {
+		t.Errorf("data before the partition was changed")
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	partMap := newTable(2)
+	partition, _ := partMap.GetPartition(0)
+	image := make([]byte, 3*mdturbo.SectorSize)
+
+	card := &memCard{}
+	if _, err := Import(context.Background(), card, partition, bytes.NewReader(image), int64(len(image)), false); err != ErrTooLarge {
+		t.Errorf("import of a known length returned %v, expected ErrTooLarge", err)
+	}
+	if len(card.data) != 0 {
+		t.Errorf("import of a known length wrote data before failing")
+	}
+	if _, err := Import(context.Background(), card, partition, bytes.NewReader(image), -1, false); err != ErrTooLarge {
+		t.Errorf("import of an unknown length returned %v, expected ErrTooLarge", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	partMap := newTable(8)
+	card := &memCard{}
+	if err := WriteTable(card, partMap); err != nil {
+		t.Fatalf("could not write table: %v", err)
+	}
+	image := make([]byte, 4*mdturbo.SectorSize)
+
+	partNum, written, err := Append(context.Background(), card, &partMap, 6, bytes.NewReader(image), -1)
+	if err != nil || partNum != 1 || written != int64(len(image)) {
+		t.Fatalf("append gave partition %d, %d bytes, error %v", partNum, written, err)
+	}
+	if partMap.PartCount() != 2 {
+		t.Errorf("table has %d partitions, expected 2", partMap.PartCount())
+	}
+	var table [512]byte
+	copy(table[:], card.data)
+	if onCard, _ := mdturbo.Deserialize(table); onCard == partMap {
+		t.Errorf("table on the card changed before WriteTable")
+	}
+	if err = WriteTable(card, partMap); err != nil {
+		t.Fatalf("could not write table: %v", err)
+	}
+	copy(table[:], card.data)
+	onCard, _ := mdturbo.Deserialize(table)
+	if onCard != partMap {
+		t.Errorf("table on the card doesn't match the returned table")
+	}
+}
+
+func TestAppendCancelled(t *testing.T) {
+	partMap := newTable(8)
+	original := partMap
+	card := &memCard{}
+	if err := WriteTable(card, partMap); err != nil {
+		t.Fatalf("could not write table: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	image := make([]byte, 4*ChunkSize)
+	src := &cancellingReader{r: bytes.NewReader(image), after: ChunkSize, cancel: cancel}
+	_, written, err := Append(ctx, card, &partMap, uint32(len(image)/mdturbo.SectorSize), src, -1)
+	if IsCancelled(err) == nil {
+		t.Fatalf("append was not cancelled: %v", err)
+	}
+	if written != ChunkSize {
+		t.Errorf("cancelled append wrote %d bytes, expected %d", written, ChunkSize)
+	}
+	if partMap != original {
+		t.Errorf("cancelled append changed the table it was given")
+	}
+	var table [512]byte
+	copy(table[:], card.data)
+	if onCard, _ := mdturbo.Deserialize(table); onCard != original {
+		t.Errorf("cancelled append changed the table on the card")
+	}
+}
+
+// badCard is a card that loses writes to its partition table
+type badCard struct {
+	memCard
+}
+
+func (b *badCard) WriteAt(p []byte, off int64) (int, error) {
+	if off == 0 {
+		return len(p), nil
+	}
+	return b.memCard.WriteAt(p, off)
+}
+
+func TestWriteTableReadBack(t *testing.T) {
+	card := &badCard{memCard{data: make([]byte, 1024)}}
+	if err := WriteTable(card, newTable(8)); err == nil {
+		t.Errorf("lost partition table write was not noticed")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/journal"
+	"github.com/disappearinjon/microdrive/mdturbo"
+)
+
+// UndoCmd contains the CLI args and flags for the undo command
+type UndoCmd struct {
+	Target    string `arg:"positional,required" help:"Microdrive/Turbo image file"`
+	Operation int    `arg:"-n" help:"Operation to undo, with every later one; default is the last"`
+	List      bool   `arg:"-l" help:"List the operations that can be undone" default:"false"`
+}
+
+// tableRange is the part of a card holding its partition table
+var tableRange = journal.Range{Offset: 0, Length: mdturbo.PartitionBlkLen}
+
+// partitionRange returns the part of a card holding a partition
+func partitionRange(partition mdturbo.Partition) journal.Range {
+	return journal.Range{
+		Offset: int64(partition.Start) * mdturbo.SectorSize,
+		Length: int64(partition.Length()) * mdturbo.SectorSize,
+	}
+}
+
+// journalName returns the name of a card's undo journal
+func journalName(card string) string {
+	return sidecarName(card, journal.Suffix)
+}
+
+// saveUndo records the parts of a card that are about to be changed in
+// its undo journal, unless --no-journal was given
+func saveUndo(target *targetCard, ranges ...journal.Range) error {
+	if cli.NoJournal {
+		return nil
+	}
+	size := int64(-1)
+	if fi, err := target.Stat(); err == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	journalFile := journalName(target.name)
+	op, err := journal.Save(journalFile, target, size, strings.Join(os.Args[1:], " "), ranges)
+	if err != nil {
+		return fmt.Errorf("could not save undo journal %s: %v", journalFile, err)
+	}
+	fmt.Fprintf(os.Stderr, "Saved undo information as operation %d in %s\n", op.Number, journalFile)
+	return nil
+}
+
+func undoOperation() error {
+	journalFile := journalName(cli.Undo.Target)
+	ops, err := journal.List(journalFile)
+	if os.IsNotExist(err) || (err == nil && len(ops) == 0) {
+		return fmt.Errorf("there is nothing to undo on %s", cli.Undo.Target)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cli.Undo.List {
+		for _, op := range ops {
+			fmt.Printf("%d\t%s\t%s\n", op.Number, op.Time.Local().Format("2006-01-02 15:04:05"), op.Command)
+		}
+		return nil
+	}
+
+	number := cli.Undo.Operation
+	if number == 0 {
+		number = ops[len(ops)-1].Number
+	}
+	if err = refuseCompressed(cli.Undo.Target); err != nil {
+		return err
+	}
+	if cli.DryRun {
+		return dryRunUndo(journalFile, number)
+	}
+	undone, err := journal.Pending(journalFile, number)
+	if err != nil {
+		return err
+	}
+	target, err := openTarget(cli.Undo.Target, false)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	// Only forget the operations once the card is safely restored
+	if err = journal.Restore(journalFile, target, undone); err != nil {
+		return err
+	}
+	if err = target.Commit(); err != nil {
+		return err
+	}
+	for _, op := range undone {
+		fmt.Fprintf(os.Stderr, "Undid operation %d: %s\n", op.Number, op.Command)
+	}
+	return journal.Forget(journalFile, undone)
+}
+
+// dryRunUndo shows what undoing operation number would do to the card
+func dryRunUndo(journalFile string, number int) error {
+	pending, err := journal.Pending(journalFile, number)
+	if err != nil {
+		return err
+	}
+	before, err := tableAt(cli.Undo.Target, 0)
+	if err != nil {
+		return err
+	}
+	// Restore the table into a stand-in, to see what it would become
+	card := &tableCard{}
+	if card.table, err = before.Serialize(); err != nil {
+		return err
+	}
+	if err = journal.Restore(journalFile, card, pending); err != nil {
+		return err
+	}
+	after, err := mdturbo.Deserialize(card.table)
+	if err != nil {
+		return err
+	}
+
+	var writes []plannedWrite
+	for _, op := range pending {
+		for _, r := range op.Ranges {
+			writes = append(writes, plannedWrite{r,
+				fmt.Sprintf("contents saved by operation %d (%s)", op.Number, op.Command)})
+		}
+	}
+	dryRun(cli.Undo.Target, before, after, writes)
+	if size := pending[len(pending)-1].Size; size >= 0 {
+		fmt.Printf("Would set the size of %s to %d bytes\n", cli.Undo.Target, size)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+import (
+	"github.com/disappearinjon/microdrive/blockdev"
+)
+
+// verifyBlockSize is the size of the blocks checked by verification
+const verifyBlockSize = 512
+
+// checksummer records checksums of data written to it: a SHA-256 of
+// all of it, and a CRC of each block, so a mismatch can be pinned down
+// to a block.
+type checksummer struct {
+	whole  hash.Hash
+	block  hash.Hash32
+	filled int      // Bytes in the current block so far
+	sums   []uint32 // CRCs of each complete block
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newChecksummer() *checksummer {
+	return &checksummer{whole: sha256.New(), block: crc32.New(crcTable)}
+}
+
+// Write adds data to the checksums
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.whole.Write(p)
+	n := len(p)
+	for len(p) > 0 {
+		chunk := verifyBlockSize - c.filled
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		c.block.Write(p[:chunk])
+		c.filled += chunk
+		p = p[chunk:]
+		if c.filled == verifyBlockSize {
+			c.endBlock()
+		}
+	}
+	return n, nil
+}
+
+// endBlock records the checksum of the current block
+func (c *checksummer) endBlock() {
+	c.sums = append(c.sums, c.block.Sum32())
+	c.block.Reset()
+	c.filled = 0
+}
+
+// finish records the checksum of any final partial block
+func (c *checksummer) finish() {
+	if c.filled > 0 {
+		c.endBlock()
+	}
+}
+
+// SHA256 returns the SHA-256 of all the data, in hex
+func (c *checksummer) SHA256() string {
+	return hex.EncodeToString(c.whole.Sum(nil))
+}
+
+// verify reads back the first length bytes of r, and checks they match
+// the data the checksums were recorded from. Returns an error naming
+// the first block that differs.
+func (c *checksummer) verify(r io.ReaderAt, length int64) error {
+	c.finish()
+	check := newChecksummer()
+	if _, err := io.Copy(check, io.NewSectionReader(r, 0, length)); err != nil {
+		return fmt.Errorf("could not read back data: %v", err)
+	}
+	check.finish()
+	for block, sum := range check.sums {
+		if block >= len(c.sums) || sum != c.sums[block] {
+			return fmt.Errorf("block %d differs", block)
+		}
+	}
+	if len(check.sums) != len(c.sums) {
+		return fmt.Errorf("block %d is missing", len(check.sums))
+	}
+	if check.SHA256() != c.SHA256() {
+		return fmt.Errorf("data differs")
+	}
+	return nil
+}
+
+// flushForVerify syncs a range of a file, and drops the kernel's cached
+// copy of it so reading it back reaches the card rather than memory.
+// Where the cache can't be dropped, it warns instead.
+func flushForVerify(file *os.File, offset, length int64) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := blockdev.DropCache(file, offset, length); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v; the data read back may come from the cache, not the card\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package woz
+
+import (
+	"fmt"
+)
+
+// SectorSize525 is the number of bytes in a 5.25" disk sector
+const SectorSize525 = 256
+
+// SectorsPerTrack525 is the number of sectors on a 16-sector 5.25" track
+const SectorsPerTrack525 = 16
+
+// Tracks525 is the number of tracks on a standard 5.25" disk
+const Tracks525 = 35
+
+// maxTracks525 is the maximum number of whole tracks we will decode
+const maxTracks525 = 40
+
+// BlockSize35 is the number of data bytes in a 3.5" disk sector
+const BlockSize35 = 512
+
+// Tracks35 is the number of tracks per side on a 3.5" disk
+const Tracks35 = 80
+
+// tagSize35 is the number of tag bytes preceding 3.5" sector data
+const tagSize35 = 12
+
+// dataSize35 is the total number of bytes in a 3.5" sector, tags
+// included
+const dataSize35 = tagSize35 + BlockSize35
+
+// chunkCount35 is the number of 3-byte groups in a 3.5" data field
+const chunkCount35 = 175
+
+// nibbles525 and nibbles35 are the number of data nibbles in a data
+// field, excluding checksums
+const (
+	nibbles525 = 342
+	nibbles35  = chunkCount35*4 - 1
+)
+
+// prodosSkew maps a ProDOS logical sector to its physical sector
+var prodosSkew = [SectorsPerTrack525]int{
+	0x0, 0x2, 0x4, 0x6, 0x8, 0xa, 0xc, 0xe,
+	0x1, 0x3, 0x5, 0x7, 0x9, 0xb, 0xd, 0xf,
+}
+
+// diskBytes62 maps 6-bit values to valid disk nibbles
+var diskBytes62 = [64]byte{
+	0x96, 0x97, 0x9a, 0x9b, 0x9d, 0x9e, 0x9f, 0xa6,
+	0xa7, 0xab, 0xac, 0xad, 0xae, 0xaf, 0xb2, 0xb3,
+	0xb4, 0xb5, 0xb6, 0xb7, 0xb9, 0xba, 0xbb, 0xbc,
+	0xbd, 0xbe, 0xbf, 0xcb, 0xcd, 0xce, 0xcf, 0xd3,
+	0xd6, 0xd7, 0xd9, 0xda, 0xdb, 0xdc, 0xdd, 0xde,
+	0xdf, 0xe5, 0xe6, 0xe7, 0xe9, 0xea, 0xeb, 0xec,
+	0xed, 0xee, 0xef, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6,
+	0xf7, 0xf9, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff,
+}
+
+// invalidNibble marks disk bytes that are not valid 6-and-2 nibbles
+const invalidNibble = 0xff
+
+// invDiskBytes62 is the inverse of diskBytes62
+var invDiskBytes62 [256]byte
+
+func init() {
+	for i := range invDiskBytes62 {
+		invDiskBytes62[i] = invalidNibble
+	}
+	for value, nibble := range diskBytes62 {
+		invDiskBytes62[nibble] = byte(value)
+	}
+}
+
+// SectorsPerTrack35 returns the number of sectors on a given 3.5"
+// track. The drive uses five speed zones of 16 tracks apiece.
+func SectorsPerTrack35(track int) int {
+	return 12 - track/16
+}
+
+// nibbles converts a track bitstream into disk nibbles. The track is
+// read twice around so that a sector spanning the index is seen intact.
+func (t *track) nibbles() []byte {
+	var reg byte
+	nibs := make([]byte, 0, t.bitCount/4)
+	for i := 0; i < t.bitCount*2; i++ {
+		pos := i % t.bitCount
+		bit := (t.bits[pos/8] >> (7 - uint(pos%8))) & 1
+		reg = reg<<1 | bit
+		if reg&0x80 != 0 {
+			nibs = append(nibs, reg)
+			reg = 0
+		}
+	}
+	return nibs
+}
+
+// findPrologue returns the index just past the next D5 AA xx sequence
+// at or after start, or -1 if none is found.
+func findPrologue(nibs []byte, start int, last byte) int {
+	for i := start; i+2 < len(nibs); i++ {
+		if nibs[i] == 0xd5 && nibs[i+1] == 0xaa && nibs[i+2] == last {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+// decode44 decodes a 4-and-4 encoded byte pair
+func decode44(hi, lo byte) byte {
+	return (hi<<1 | 0x01) & lo
+}
+
+// decode525 decodes a 16-sector 5.25" disk into ProDOS order
+func (img *Image) decode525() ([]byte, error) {
+	tracks := Tracks525
+	for t := Tracks525; t < maxTracks525; t++ {
+		if img.trackFor(t*4) != nil {
+			tracks = t + 1
+		}
+	}
+
+	result := make([]byte, tracks*SectorsPerTrack525*SectorSize525)
+	for t := 0; t < tracks; t++ {
+		trk := img.trackFor(t * 4)
+		if trk == nil {
+			return nil, &TrackError{Track: t, Expected: SectorsPerTrack525, Reason: "no track data"}
+		}
+		nibs := trk.nibbles()
+		sectors := decodeTrack525(nibs, t)
+		if len(sectors) != SectorsPerTrack525 {
+			reason := "missing or damaged sectors"
+			if findPrologue(nibs, 0, 0xb5) != -1 {
+				reason = "13-sector (DOS 3.2) format is not supported"
+			}
+			return nil, &TrackError{Track: t, Found: len(sectors),
+				Expected: SectorsPerTrack525, Reason: reason}
+		}
+		for logical, physical := range prodosSkew {
+			offset := (t*SectorsPerTrack525 + logical) * SectorSize525
+			copy(result[offset:], sectors[physical])
+		}
+	}
+	return result, nil
+}
+
+// decodeTrack525 returns all of the physical sectors that can be
+// decoded from a 5.25" track, keyed by sector number.
+func decodeTrack525(nibs []byte, trackNum int) map[int][]byte {
+	sectors := make(map[int][]byte)
+	for pos := findPrologue(nibs, 0, 0x96); pos != -1; pos = findPrologue(nibs, pos, 0x96) {
+		if pos+8 > len(nibs) {
+			break
+		}
+		volume := decode44(nibs[pos], nibs[pos+1])
+		track := decode44(nibs[pos+2], nibs[pos+3])
+		sector := decode44(nibs[pos+4], nibs[pos+5])
+		checksum := decode44(nibs[pos+6], nibs[pos+7])
+		pos += 8
+		if volume^track^sector != checksum || int(track) != trackNum ||
+			sector >= SectorsPerTrack525 {
+			continue
+		}
+		if _, ok := sectors[int(sector)]; ok {
+			continue
+		}
+
+		// The data field should follow closely after the address
+		// field; don't pick up the next sector's data by mistake
+		data := findPrologue(nibs, pos, 0xad)
+		if data == -1 || data-pos > 64 || data+nibbles525+1 > len(nibs) {
+			continue
+		}
+		if buf, err := decodeData525(nibs[data : data+nibbles525+1]); err == nil {
+			sectors[int(sector)] = buf
+		}
+	}
+	return sectors
+}
+
+// decodeData525 decodes the 343 nibbles of a 6-and-2 data field,
+// checksum included, into a 256-byte sector.
+func decodeData525(nibs []byte) ([]byte, error) {
+	var values [nibbles525]byte
+	var prev byte
+
+	for i := 0; i < nibbles525; i++ {
+		value := invDiskBytes62[nibs[i]]
+		if value == invalidNibble {
+			return nil, fmt.Errorf("invalid nibble 0x%02x", nibs[i])
+		}
+		prev ^= value
+		values[i] = prev
+	}
+	checksum := invDiskBytes62[nibs[nibbles525]]
+	if checksum != prev {
+		return nil, fmt.Errorf("data checksum mismatch")
+	}
+
+	// The first 86 values hold the low two bits of each byte, bit
+	// reversed; the remaining 256 hold the top six bits.
+	const auxCount = nibbles525 - SectorSize525
+	result := make([]byte, SectorSize525)
+	for i := range result {
+		twos := values[i%auxCount] >> (2 * uint(i/auxCount)) & 0x03
+		twos = (twos&0x01)<<1 | (twos&0x02)>>1
+		result[i] = values[auxCount+i]<<2 | twos
+	}
+	return result, nil
+}
+
+// decode35 decodes a 3.5" GCR disk into ProDOS order
+func (img *Image) decode35() ([]byte, error) {
+	sides := img.Sides()
+	var blocks int
+	for t := 0; t < Tracks35; t++ {
+		blocks += SectorsPerTrack35(t) * sides
+	}
+
+	result := make([]byte, 0, blocks*BlockSize35)
+	for t := 0; t < Tracks35; t++ {
+		for side := 0; side < sides; side++ {
+			expected := SectorsPerTrack35(t)
+			trk := img.trackFor(t*2 + side)
+			if trk == nil {
+				return nil, &TrackError{Track: t, Side: side, Expected: expected,
+					Reason: "no track data"}
+			}
+			sectors := decodeTrack35(trk.nibbles(), t, side)
+			if len(sectors) != expected {
+				return nil, &TrackError{Track: t, Side: side, Found: len(sectors),
+					Expected: expected, Reason: "missing or damaged sectors"}
+			}
+			for s := 0; s < expected; s++ {
+				result = append(result, sectors[s]...)
+			}
+		}
+	}
+	return result, nil
+}
+
+// decodeTrack35 returns all of the sectors that can be decoded from a
+// 3.5" track, keyed by sector number, with the tag bytes removed.
+func decodeTrack35(nibs []byte, trackNum, sideNum int) map[int][]byte {
+	sectors := make(map[int][]byte)
+	for pos := findPrologue(nibs, 0, 0x96); pos != -1; pos = findPrologue(nibs, pos, 0x96) {
+		if pos+5 > len(nibs) {
+			break
+		}
+		var field [5]byte
+		valid := true
+		for i := range field {
+			field[i] = invDiskBytes62[nibs[pos+i]]
+			if field[i] == invalidNibble {
+				valid = false
+			}
+		}
+		pos += len(field)
+		track, sector, side, format, checksum := field[0], field[1], field[2], field[3], field[4]
+		if !valid || track^sector^side^format != checksum {
+			continue
+		}
+		// The side byte holds the side in bit 5 and the high bits
+		// of the track number below that
+		if int(track)|int(side&0x1f)<<6 != trackNum || int(side>>5&0x01) != sideNum {
+			continue
+		}
+		if int(sector) >= SectorsPerTrack35(trackNum) {
+			continue
+		}
+		if _, ok := sectors[int(sector)]; ok {
+			continue
+		}
+
+		data := findPrologue(nibs, pos, 0xad)
+		if data == -1 || data-pos > 64 || data+1+nibbles35+4 > len(nibs) {
+			continue
+		}
+		if invDiskBytes62[nibs[data]] != sector {
+			continue
+		}
+		if buf, err := decodeData35(nibs[data+1 : data+1+nibbles35+4]); err == nil {
+			sectors[int(sector)] = buf[tagSize35:]
+		}
+	}
+	return sectors
+}
+
+// decodeData35 decodes the 699 data nibbles and 4 checksum nibbles of a
+// 3.5" data field into 524 bytes of tags and data.
+func decodeData35(nibs []byte) ([]byte, error) {
+	var part0, part1, part2 [chunkCount35]byte
+	var pos int
+
+	next := func() byte {
+		value := invDiskBytes62[nibs[pos]]
+		pos++
+		return value
+	}
+
+	// Each group is a nibble holding the top two bits of each of
+	// the three bytes, followed by the low six bits of each.
+	for i := 0; i < chunkCount35; i++ {
+		twos, nib0, nib1 := next(), next(), next()
+		var nib2 byte
+		if i != chunkCount35-1 {
+			nib2 = next()
+		}
+		if twos|nib0|nib1|nib2 == invalidNibble {
+			return nil, fmt.Errorf("invalid nibble in data field")
+		}
+		part0[i] = nib0 | (twos<<2)&0xc0
+		part1[i] = nib1 | (twos<<4)&0xc0
+		part2[i] = nib2 | (twos<<6)&0xc0
+	}
+
+	// The three bytes of each group are also XORed with a set of
+	// rolling checksums
+	var chk0, chk1, chk2 uint
+	result := make([]byte, 0, dataSize35)
+	for i := 0; ; i++ {
+		chk0 = (chk0 & 0xff) << 1
+		if chk0&0x100 != 0 {
+			chk0++
+		}
+
+		value := part0[i] ^ byte(chk0)
+		chk2 += uint(value)
+		if chk0&0x100 != 0 {
+			chk2++
+			chk0 &= 0xff
+		}
+		result = append(result, value)
+
+		value = part1[i] ^ byte(chk2)
+		chk1 += uint(value)
+		if chk2 > 0xff {
+			chk1++
+			chk2 &= 0xff
+		}
+		result = append(result, value)
+
+		if len(result) == dataSize35 {
+			break
+		}
+
+		value = part2[i] ^ byte(chk1)
+		chk0 += uint(value)
+		if chk1 > 0xff {
+			chk0++
+			chk1 &= 0xff
+		}
+		result = append(result, value)
+	}
+
+	twos, nib0, nib1, nib2 := next(), next(), next(), next()
+	if twos|nib0|nib1|nib2 == invalidNibble {
+		return nil, fmt.Errorf("invalid nibble in checksum")
+	}
+	if nib0|(twos<<2)&0xc0 != byte(chk0) ||
+		nib1|(twos<<4)&0xc0 != byte(chk1) ||
+		nib2|(twos<<6)&0xc0 != byte(chk2) {
+		return nil, fmt.Errorf("data checksum mismatch")
+	}
+	return result, nil
+}
@@ -0,0 +1,271 @@
+// Package woz provides support for the WOZ 1.0 and 2.0 disk image
+// formats, as documented at https://applesaucefdc.com/woz/reference2/
+//
+// WOZ images hold the raw bitstream of each track, rather than the
+// decoded sector data. This package only implements enough to decode
+// standard (unprotected) 16-sector 5.25" disks and 3.5" GCR disks into
+// ProDOS-ordered block images; copy-protected tracks are reported
+// rather than decoded.
+package woz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// HeaderSize is the number of bytes in the WOZ file header, before the
+// first chunk
+const HeaderSize = 12
+
+const (
+	// DiskType525 is the INFO disk type for a 5.25" disk
+	DiskType525 = 1
+	// DiskType35 is the INFO disk type for a 3.5" disk
+	DiskType35 = 2
+)
+
+// TMapSize is the number of entries in the TMAP chunk
+const TMapSize = 160
+
+// NoTrack is the TMAP value indicating no track data
+const NoTrack = 0xff
+
+// trk1Size is the size of a single WOZ1 TRK entry: 6646 bytes of
+// bitstream followed by 10 bytes of track metadata.
+const trk1Size = 6656
+
+// trk1BitsSize is the number of bitstream bytes in a WOZ1 TRK entry
+const trk1BitsSize = 6646
+
+// trk2Size is the size of a single WOZ2 TRK entry
+const trk2Size = 8
+
+// blockSize is the size of a WOZ2 file block, used for TRK offsets
+const blockSize = 512
+
+var magicWOZ1 = []byte("WOZ1\xff\n\r\n")
+var magicWOZ2 = []byte("WOZ2\xff\n\r\n")
+
+// Info is the parsed content of the WOZ INFO chunk. Fields only
+// present in WOZ2 images are left at zero for WOZ1 images.
+type Info struct {
+	Version        uint8  // INFO chunk version
+	DiskType       uint8  // DiskType525 or DiskType35
+	WriteProtected bool   // Floppy was write protected
+	Synchronized   bool   // Cross-track sync was used during imaging
+	Cleaned        bool   // MC3470 fake bits have been removed
+	Creator        string // Name of the creating software
+	DiskSides      uint8  // Number of disk sides (WOZ2 only)
+}
+
+// track is the bitstream of a single track
+type track struct {
+	bits     []byte // Bitstream, MSB first
+	bitCount int    // Number of valid bits in the bitstream
+}
+
+// Image is a parsed WOZ image
+type Image struct {
+	Version int // 1 or 2
+	Info    Info
+
+	tmap   [TMapSize]uint8
+	tracks []track
+}
+
+// IsWOZ returns true if the data begins with a WOZ1 or WOZ2 header
+func IsWOZ(data []byte) bool {
+	if len(data) < len(magicWOZ1) {
+		return false
+	}
+	return bytes.Equal(data[:len(magicWOZ1)], magicWOZ1) ||
+		bytes.Equal(data[:len(magicWOZ2)], magicWOZ2)
+}
+
+// Parse reads a complete WOZ file and returns the parsed image, or an
+// error if it is not a valid WOZ file.
+func Parse(data []byte) (*Image, error) {
+	var img Image
+	var haveInfo, haveTMap, haveTrks bool
+
+	if len(data) < HeaderSize {
+		return nil, fmt.Errorf("woz: file too short (%d bytes)", len(data))
+	}
+	switch {
+	case bytes.Equal(data[:len(magicWOZ1)], magicWOZ1):
+		img.Version = 1
+	case bytes.Equal(data[:len(magicWOZ2)], magicWOZ2):
+		img.Version = 2
+	default:
+		return nil, fmt.Errorf("woz: magic number did not match")
+	}
+
+	// A zero CRC means the creator did not compute one
+	crc := binary.LittleEndian.Uint32(data[8:12])
+	if crc != 0 && crc != crc32.ChecksumIEEE(data[HeaderSize:]) {
+		return nil, fmt.Errorf("woz: CRC mismatch; image is corrupt")
+	}
+
+	for offset := HeaderSize; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		offset += 8
+		if size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("woz: chunk %s runs past end of file", id)
+		}
+		chunk := data[offset : offset+size]
+		offset += size
+
+		switch id {
+		case "INFO":
+			if err := img.parseInfo(chunk); err != nil {
+				return nil, err
+			}
+			haveInfo = true
+		case "TMAP":
+			if len(chunk) < TMapSize {
+				return nil, fmt.Errorf("woz: TMAP chunk too short (%d bytes)", len(chunk))
+			}
+			copy(img.tmap[:], chunk)
+			haveTMap = true
+		case "TRKS":
+			if err := img.parseTracks(chunk, data); err != nil {
+				return nil, err
+			}
+			haveTrks = true
+		default:
+			// META, WRIT, FLUX and unknown chunks are ignored
+		}
+	}
+
+	if !haveInfo || !haveTMap || !haveTrks {
+		return nil, fmt.Errorf("woz: missing required INFO, TMAP or TRKS chunk")
+	}
+	for i, t := range img.tmap {
+		if t != NoTrack && int(t) >= len(img.tracks) {
+			return nil, fmt.Errorf("woz: TMAP entry %d refers to missing track %d", i, t)
+		}
+	}
+	return &img, nil
+}
+
+// parseInfo fills in the Info structure from an INFO chunk
+func (img *Image) parseInfo(chunk []byte) error {
+	if len(chunk) < 37 {
+		return fmt.Errorf("woz: INFO chunk too short (%d bytes)", len(chunk))
+	}
+	img.Info = Info{
+		Version:        chunk[0],
+		DiskType:       chunk[1],
+		WriteProtected: chunk[2] == 1,
+		Synchronized:   chunk[3] == 1,
+		Cleaned:        chunk[4] == 1,
+		Creator:        string(bytes.TrimRight(chunk[5:37], " \x00")),
+	}
+	if img.Info.Version >= 2 && len(chunk) > 37 {
+		img.Info.DiskSides = chunk[37]
+	}
+	if img.Info.DiskType != DiskType525 && img.Info.DiskType != DiskType35 {
+		return fmt.Errorf("woz: unknown disk type %d", img.Info.DiskType)
+	}
+	return nil
+}
+
+// parseTracks extracts the track bitstreams from a TRKS chunk. WOZ2
+// track data is addressed relative to the start of the file, so the
+// whole file is required.
+func (img *Image) parseTracks(chunk, file []byte) error {
+	if img.Version == 1 {
+		for offset := 0; offset+trk1Size <= len(chunk); offset += trk1Size {
+			trk := chunk[offset : offset+trk1Size]
+			bitCount := int(binary.LittleEndian.Uint16(trk[trk1BitsSize+2:]))
+			if bitCount > trk1BitsSize*8 {
+				return fmt.Errorf("woz: track %d bit count %d too large", len(img.tracks), bitCount)
+			}
+			img.tracks = append(img.tracks, track{bits: trk[:trk1BitsSize], bitCount: bitCount})
+		}
+		return nil
+	}
+
+	if len(chunk) < TMapSize*trk2Size {
+		return fmt.Errorf("woz: TRKS chunk too short (%d bytes)", len(chunk))
+	}
+	for i := 0; i < TMapSize; i++ {
+		trk := chunk[i*trk2Size : (i+1)*trk2Size]
+		start := int(binary.LittleEndian.Uint16(trk[0:2])) * blockSize
+		length := int(binary.LittleEndian.Uint16(trk[2:4])) * blockSize
+		bitCount := int(binary.LittleEndian.Uint32(trk[4:8]))
+		if start == 0 && length == 0 {
+			img.tracks = append(img.tracks, track{})
+			continue
+		}
+		if start+length > len(file) || bitCount > length*8 {
+			return fmt.Errorf("woz: track %d data out of range", i)
+		}
+		img.tracks = append(img.tracks, track{bits: file[start : start+length], bitCount: bitCount})
+	}
+	return nil
+}
+
+// Sides returns the number of disk sides in the image
+func (img *Image) Sides() int {
+	if img.Info.DiskType == DiskType525 {
+		return 1
+	}
+	if img.Info.DiskSides == 1 || img.Info.DiskSides == 2 {
+		return int(img.Info.DiskSides)
+	}
+	// WOZ1 3.5" images don't record sides; look for side 1 tracks
+	for i := 1; i < TMapSize; i += 2 {
+		if img.tmap[i] != NoTrack {
+			return 2
+		}
+	}
+	return 1
+}
+
+// Decode converts the image into a ProDOS-ordered block image. 5.25"
+// disks must use 16-sector 6-and-2 encoding (DOS 3.3 or ProDOS); 3.5"
+// disks must use standard Apple GCR. If any track cannot be decoded,
+// most likely because of copy protection, a *TrackError is returned.
+func (img *Image) Decode() ([]byte, error) {
+	switch img.Info.DiskType {
+	case DiskType525:
+		return img.decode525()
+	case DiskType35:
+		return img.decode35()
+	default:
+		return nil, fmt.Errorf("woz: unknown disk type %d", img.Info.DiskType)
+	}
+}
+
+// trackFor returns the bitstream for a given TMAP index, or nil if the
+// track has no data.
+func (img *Image) trackFor(index int) *track {
+	if index >= TMapSize || img.tmap[index] == NoTrack {
+		return nil
+	}
+	t := &img.tracks[img.tmap[index]]
+	if t.bitCount == 0 {
+		return nil
+	}
+	return t
+}
+
+// TrackError is returned when a track cannot be decoded into sectors,
+// typically because the disk is copy-protected.
+type TrackError struct {
+	Track    int    // Track number
+	Side     int    // Disk side (always 0 for 5.25" disks)
+	Found    int    // Number of sectors successfully decoded
+	Expected int    // Number of sectors expected
+	Reason   string // Description of the failure
+}
+
+// Error returns a description of the undecodable track
+func (e *TrackError) Error() string {
+	return fmt.Sprintf("woz: track %d side %d: %s (decoded %d of %d sectors); disk may be copy-protected",
+		e.Track, e.Side, e.Reason, e.Found, e.Expected)
+}
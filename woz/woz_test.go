@@ -0,0 +1,347 @@
+package woz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// bitWriter accumulates a track bitstream for test images
+type bitWriter struct {
+	bits  []byte
+	count int
+}
+
+func (w *bitWriter) bit(b byte) {
+	if w.count%8 == 0 {
+		w.bits = append(w.bits, 0)
+	}
+	w.bits[w.count/8] |= b << (7 - uint(w.count%8))
+	w.count++
+}
+
+func (w *bitWriter) nibble(n byte) {
+	for i := 7; i >= 0; i-- {
+		w.bit(n >> uint(i) & 1)
+	}
+}
+
+// sync writes 10-bit self-sync bytes
+func (w *bitWriter) sync(count int) {
+	for i := 0; i < count; i++ {
+		w.nibble(0xff)
+		w.bit(0)
+		w.bit(0)
+	}
+}
+
+func encode44(value byte) (byte, byte) {
+	return value>>1 | 0xaa, value | 0xaa
+}
+
+// encodeTrack525 builds a 16-sector track whose physical sector n is
+// filled with sectorData(n)
+func encodeTrack525(trackNum int, sectorData func(int) []byte) *bitWriter {
+	var w bitWriter
+	w.sync(40)
+	for s := 0; s < SectorsPerTrack525; s++ {
+		w.nibble(0xd5)
+		w.nibble(0xaa)
+		w.nibble(0x96)
+		fields := []byte{254, byte(trackNum), byte(s), 254 ^ byte(trackNum) ^ byte(s)}
+		for _, f := range fields {
+			hi, lo := encode44(f)
+			w.nibble(hi)
+			w.nibble(lo)
+		}
+		w.nibble(0xde)
+		w.nibble(0xaa)
+		w.nibble(0xeb)
+		w.sync(6)
+
+		data := sectorData(s)
+		var values [nibbles525]byte
+		for i, b := range data {
+			twos := b & 0x03
+			twos = (twos&0x01)<<1 | (twos&0x02)>>1
+			values[i%86] |= twos << (2 * uint(i/86))
+			values[86+i] = b >> 2
+		}
+		w.nibble(0xd5)
+		w.nibble(0xaa)
+		w.nibble(0xad)
+		var prev byte
+		for _, v := range values {
+			w.nibble(diskBytes62[v^prev])
+			prev = v
+		}
+		w.nibble(diskBytes62[prev])
+		w.nibble(0xde)
+		w.nibble(0xaa)
+		w.nibble(0xeb)
+		w.sync(16)
+	}
+	return &w
+}
+
+// encodeData35 builds the nibbles for a 524-byte 3.5" sector
+func encodeData35(data []byte) []byte {
+	var part0, part1, part2 [chunkCount35]byte
+	var chk0, chk1, chk2 uint
+	for i, off := 0, 0; ; i++ {
+		chk0 = (chk0 & 0xff) << 1
+		if chk0&0x100 != 0 {
+			chk0++
+		}
+		value := data[off]
+		part0[i] = value ^ byte(chk0)
+		chk2 += uint(value)
+		if chk0&0x100 != 0 {
+			chk2++
+			chk0 &= 0xff
+		}
+		value = data[off+1]
+		part1[i] = value ^ byte(chk2)
+		chk1 += uint(value)
+		if chk2 > 0xff {
+			chk1++
+			chk2 &= 0xff
+		}
+		off += 2
+		if off == dataSize35 {
+			break
+		}
+		value = data[off]
+		part2[i] = value ^ byte(chk1)
+		chk0 += uint(value)
+		if chk1 > 0xff {
+			chk0++
+			chk1 &= 0xff
+		}
+		off++
+	}
+
+	var nibs []byte
+	group := func(a, b, c byte, last bool) {
+		twos := (a>>2)&0x30 | (b>>4)&0x0c | (c>>6)&0x03
+		nibs = append(nibs, diskBytes62[twos], diskBytes62[a&0x3f], diskBytes62[b&0x3f])
+		if !last {
+			nibs = append(nibs, diskBytes62[c&0x3f])
+		}
+	}
+	for i := 0; i < chunkCount35; i++ {
+		group(part0[i], part1[i], part2[i], i == chunkCount35-1)
+	}
+	group(byte(chk0), byte(chk1), byte(chk2), false)
+	return nibs
+}
+
+// encodeTrack35 builds a 3.5" track whose sector n is filled with
+// sectorData(n)
+func encodeTrack35(trackNum, side int, sectorData func(int) []byte) *bitWriter {
+	var w bitWriter
+	w.sync(40)
+	for s := 0; s < SectorsPerTrack35(trackNum); s++ {
+		sideByte := byte(side<<5 | trackNum>>6)
+		fields := []byte{byte(trackNum & 0x3f), byte(s), sideByte, 0x22}
+		fields = append(fields, fields[0]^fields[1]^fields[2]^fields[3])
+		w.nibble(0xd5)
+		w.nibble(0xaa)
+		w.nibble(0x96)
+		for _, f := range fields {
+			w.nibble(diskBytes62[f])
+		}
+		w.nibble(0xde)
+		w.nibble(0xaa)
+		w.sync(5)
+
+		w.nibble(0xd5)
+		w.nibble(0xaa)
+		w.nibble(0xad)
+		w.nibble(diskBytes62[s])
+		data := append(make([]byte, tagSize35), sectorData(s)...)
+		for _, n := range encodeData35(data) {
+			w.nibble(n)
+		}
+		w.nibble(0xde)
+		w.nibble(0xaa)
+		w.sync(20)
+	}
+	return &w
+}
+
+// buildWOZ2 assembles a WOZ2 file from per-TMAP-index tracks
+func buildWOZ2(diskType, sides byte, tracks map[int]*bitWriter) []byte {
+	info := make([]byte, 60)
+	info[0] = 2
+	info[1] = diskType
+	copy(info[5:37], bytes.Repeat([]byte(" "), 32))
+	copy(info[5:], "microdrive test")
+	info[37] = sides
+
+	var tmap [TMapSize]byte
+	for i := range tmap {
+		tmap[i] = NoTrack
+	}
+
+	trks := make([]byte, TMapSize*trk2Size)
+	var trackData []byte
+	// header + INFO + TMAP + TRKS header lands us at block 3
+	nextBlock := 3
+	trackNum := 0
+	for i := 0; i < TMapSize; i++ {
+		w, ok := tracks[i]
+		if !ok {
+			continue
+		}
+		tmap[i] = byte(trackNum)
+		blocks := (len(w.bits) + blockSize - 1) / blockSize
+		entry := trks[trackNum*trk2Size:]
+		binary.LittleEndian.PutUint16(entry[0:], uint16(nextBlock))
+		binary.LittleEndian.PutUint16(entry[2:], uint16(blocks))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(w.count))
+		padded := make([]byte, blocks*blockSize)
+		copy(padded, w.bits)
+		trackData = append(trackData, padded...)
+		nextBlock += blocks
+		trackNum++
+	}
+
+	var out bytes.Buffer
+	out.Write(magicWOZ2)
+	out.Write(make([]byte, 4))
+	chunk := func(id string, data []byte) {
+		out.WriteString(id)
+		binary.Write(&out, binary.LittleEndian, uint32(len(data)))
+		out.Write(data)
+	}
+	chunk("INFO", info)
+	chunk("TMAP", tmap[:])
+	// Pad so that track data starts on a block boundary
+	trksHeader := append(trks, make([]byte, 3*blockSize-out.Len()-8-len(trks))...)
+	chunk("TRKS", append(trksHeader, trackData...))
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[8:], crc32.ChecksumIEEE(result[HeaderSize:]))
+	return result
+}
+
+// fill returns a sector's worth of bytes derived from a seed
+func fill(size, seed int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(seed*7 + i*13)
+	}
+	return buf
+}
+
+func TestIsWOZ(t *testing.T) {
+	if !IsWOZ([]byte("WOZ2\xff\n\r\nxxxx")) {
+		t.Errorf("WOZ2 header not recognized")
+	}
+	if IsWOZ([]byte("2IMG")) {
+		t.Errorf("2MG header recognized as WOZ")
+	}
+}
+
+func TestDecode525(t *testing.T) {
+	tracks := make(map[int]*bitWriter)
+	for trk := 0; trk < Tracks525; trk++ {
+		trk := trk
+		tracks[trk*4] = encodeTrack525(trk, func(s int) []byte {
+			return fill(SectorSize525, trk*SectorsPerTrack525+s)
+		})
+	}
+	img, err := Parse(buildWOZ2(DiskType525, 1, tracks))
+	if err != nil {
+		t.Fatalf("could not parse image: %v", err)
+	}
+	data, err := img.Decode()
+	if err != nil {
+		t.Fatalf("could not decode image: %v", err)
+	}
+	if len(data) != Tracks525*SectorsPerTrack525*SectorSize525 {
+		t.Fatalf("decoded length %d", len(data))
+	}
+
+	// ProDOS logical sector 1 is physical sector 2
+	want := fill(SectorSize525, 5*SectorsPerTrack525+2)
+	offset := (5*SectorsPerTrack525 + 1) * SectorSize525
+	if !bytes.Equal(data[offset:offset+SectorSize525], want) {
+		t.Errorf("track 5 logical sector 1 did not match physical sector 2")
+	}
+}
+
+func TestDecode525Protected(t *testing.T) {
+	tracks := make(map[int]*bitWriter)
+	for trk := 0; trk < Tracks525; trk++ {
+		tracks[trk*4] = encodeTrack525(trk, func(s int) []byte {
+			return fill(SectorSize525, s)
+		})
+	}
+	// Mangle track 17's prologues, as many protection schemes do
+	bits := tracks[17*4].bits
+	for i := range bits {
+		bits[i] ^= 0x5a
+	}
+
+	img, err := Parse(buildWOZ2(DiskType525, 1, tracks))
+	if err != nil {
+		t.Fatalf("could not parse image: %v", err)
+	}
+	_, err = img.Decode()
+	var trackErr *TrackError
+	if !errors.As(err, &trackErr) {
+		t.Fatalf("expected TrackError, got %v", err)
+	}
+	if trackErr.Track != 17 {
+		t.Errorf("expected failure on track 17, got %d", trackErr.Track)
+	}
+}
+
+func TestDecode35(t *testing.T) {
+	tracks := make(map[int]*bitWriter)
+	block := 0
+	for trk := 0; trk < Tracks35; trk++ {
+		for side := 0; side < 2; side++ {
+			first := block
+			tracks[trk*2+side] = encodeTrack35(trk, side, func(s int) []byte {
+				return fill(BlockSize35, first+s)
+			})
+			block += SectorsPerTrack35(trk)
+		}
+	}
+	if block != 1600 {
+		t.Fatalf("test setup produced %d blocks", block)
+	}
+
+	img, err := Parse(buildWOZ2(DiskType35, 2, tracks))
+	if err != nil {
+		t.Fatalf("could not parse image: %v", err)
+	}
+	data, err := img.Decode()
+	if err != nil {
+		t.Fatalf("could not decode image: %v", err)
+	}
+	if len(data) != 1600*BlockSize35 {
+		t.Fatalf("decoded length %d", len(data))
+	}
+	for _, b := range []int{0, 2, 799, 1599} {
+		got := data[b*BlockSize35 : (b+1)*BlockSize35]
+		if !bytes.Equal(got, fill(BlockSize35, b)) {
+			t.Errorf("block %d did not match", b)
+		}
+	}
+}
+
+func TestParseBadCRC(t *testing.T) {
+	data := buildWOZ2(DiskType525, 1, map[int]*bitWriter{0: encodeTrack525(0, func(s int) []byte {
+		return fill(SectorSize525, s)
+	})})
+	data[len(data)-1] ^= 0xff
+	if _, err := Parse(data); err == nil {
+		t.Errorf("corrupt image parsed without error")
+	}
+}
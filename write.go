@@ -3,12 +3,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 )
 
 import (
+	"github.com/disappearinjon/microdrive/journal"
 	"github.com/disappearinjon/microdrive/mdturbo"
+	"github.com/disappearinjon/microdrive/transfer"
 )
 
 // WriteCmd contains the CLI args and flags for Write command
@@ -23,13 +26,9 @@ func writePartition() error {
 	var input *os.File
 	var err error
 
-	// Open the file passed in for writing - create a new file if
-	// nothing present
-	imagefile, err := os.OpenFile(cli.Write.Image, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
+	if err = refuseCompressed(cli.Write.Image); err != nil {
 		return err
 	}
-	defer imagefile.Close()
 
 	// Get input file
 	switch cli.Write.File {
@@ -66,11 +65,50 @@ func writePartition() error {
 	if err != nil {
 		return fmt.Errorf("could not serialize partition table: %v", err)
 	}
+	where := journal.Range{Offset: cli.Write.Offset, Length: int64(len(pt))}
+	if cli.DryRun {
+		current, err := tableAt(cli.Write.Image, cli.Write.Offset)
+		if err != nil {
+			return err
+		}
+		dryRun(cli.Write.Image, current, mdt, []plannedWrite{{where, "partition table"}})
+		return nil
+	}
 
-	write, err := imagefile.WriteAt(pt[:], cli.Write.Offset)
+	// Open the file passed in for writing - create a new file if
+	// nothing present
+	imagefile, err := openTarget(cli.Write.Image, true)
 	if err != nil {
-		return fmt.Errorf("failed to write image! wrote %d bytes with error %v", write, err)
+		return err
 	}
+	defer imagefile.Close()
 
-	return nil
+	err = saveUndo(imagefile, where)
+	if err != nil {
+		return err
+	}
+	if err = transfer.WriteTableAt(imagefile, cli.Write.Offset, mdt); err != nil {
+		return fmt.Errorf("failed to write image! %v", err)
+	}
+
+	return imagefile.Commit()
+}
+
+// tableAt reads the partition table at offset in a card image or
+// device. A card that doesn't exist yet, or is too short, has an empty
+// table.
+func tableAt(filename string, offset int64) (mdturbo.MDTurbo, error) {
+	var sector [mdturbo.PartitionBlkLen]byte
+	file, err := openCardFile(filename)
+	if os.IsNotExist(err) {
+		return mdturbo.Deserialize(sector)
+	}
+	if err != nil {
+		return mdturbo.MDTurbo{}, err
+	}
+	defer file.Close()
+	if _, err = file.ReadAt(sector[:], offset); err != nil && err != io.EOF {
+		return mdturbo.MDTurbo{}, err
+	}
+	return mdturbo.Deserialize(sector)
 }